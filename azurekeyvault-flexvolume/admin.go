@@ -0,0 +1,263 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// adminCommand is an admin subcommand, run with the provider and credentials of the flags
+type adminCommand struct {
+	usage string
+	// number of positional arguments: the minimum and the maximum
+	minArgs, maxArgs int
+	run              func(ctx context.Context, backend Backend, args []string, w io.Writer) error
+}
+
+// adminCommands inspect the objects a pod would see from a node, with the same identity and cloud resolution
+var adminCommands = map[string]adminCommand{
+	"list": {
+		usage:   "list <secret|key|cert>",
+		minArgs: 1, maxArgs: 1,
+		run: adminList,
+	},
+	"versions": {
+		usage:   "versions <secret|key|cert> <name>",
+		minArgs: 2, maxArgs: 2,
+		run: adminVersions,
+	},
+	"get": {
+		usage:   "get <secret|key|cert> <name> [version]",
+		minArgs: 2, maxArgs: 3,
+		run: adminGet,
+	},
+	"show": {
+		usage:   "show <secret|key|cert> <name> [version]",
+		minArgs: 2, maxArgs: 3,
+		run: adminShow,
+	},
+	"encrypt": {
+		usage:   "encrypt key <name> [version] < plaintext > file.enc",
+		minArgs: 2, maxArgs: 3,
+		run: adminEncrypt,
+	},
+}
+
+func runList(args []string) int     { return runAdminCommand("list", args) }
+func runVersions(args []string) int { return runAdminCommand("versions", args) }
+func runGet(args []string) int      { return runAdminCommand("get", args) }
+func runShow(args []string) int     { return runAdminCommand("show", args) }
+func runEncrypt(args []string) int  { return runAdminCommand("encrypt", args) }
+
+// runAdminCommand parses the flags and positional arguments of an admin subcommand and runs it
+func runAdminCommand(name string, args []string) int {
+	command := adminCommands[name]
+	options := Option{readOnly: true}
+	registerFlags(flag.CommandLine, &options)
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s %s [flags]\n", program, command.usage)
+		flag.PrintDefaults()
+	}
+
+	// the positional arguments can be before or after the flags
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+	positional = append(positional, flag.Args()...)
+	defer glog.Flush()
+
+	if len(positional) < command.minArgs || len(positional) > command.maxArgs {
+		flag.CommandLine.Usage()
+		return 1
+	}
+	objectType := positional[0]
+	if objectType != VaultTypeSecret && objectType != VaultTypeKey && objectType != VaultTypeCertificate {
+		glog.Errorf("[error] : invalid object type %q, should be secret, key, or cert", objectType)
+		return 1
+	}
+	if err := validateProviderOptions(options); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	if err := configureHTTPClient(options.transport); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	backend, err := newBackend(ctx, options)
+	if err != nil {
+		glog.Errorf("[error] : failed to initialize the %s provider: %s", options.provider, err)
+		return 1
+	}
+	if err := command.run(ctx, backend, positional, os.Stdout); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	return 0
+}
+
+// adminList prints the objects of a type
+func adminList(ctx context.Context, backend Backend, args []string, w io.Writer) error {
+	items, err := backend.List(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tENABLED\tUPDATED\tEXPIRES")
+	for _, item := range items {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", item.Name, formatEnabled(item.Enabled), formatTime(item.Updated), formatTime(item.Expires))
+	}
+	return table.Flush()
+}
+
+// adminVersions prints the versions of an object
+func adminVersions(ctx context.Context, backend Backend, args []string, w io.Writer) error {
+	items, err := backend.Versions(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tENABLED\tCREATED\tNOT BEFORE\tEXPIRES")
+	for _, item := range items {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", item.Version, formatEnabled(item.Enabled), formatTime(item.Created), formatTime(item.NotBefore), formatTime(item.Expires))
+	}
+	return table.Flush()
+}
+
+// adminGet prints the content of an object, as it would be written in the volume
+func adminGet(ctx context.Context, backend Backend, args []string, w io.Writer) error {
+	bundle, err := adminObject(ctx, backend, args)
+	if err != nil {
+		return err
+	}
+	content, err := formatObject(bundle)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// adminShow prints the attributes of an object, without its value
+func adminShow(ctx context.Context, backend Backend, args []string, w io.Writer) error {
+	bundle, err := adminObject(ctx, backend, args)
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fields := [][2]string{
+		{"Type", bundle.Type},
+		{"Name", bundle.Name},
+		{"Version", bundle.Version},
+		{"Enabled", formatEnabled(bundle.Enabled)},
+		{"Created", formatTime(bundle.Created)},
+		{"Updated", formatTime(bundle.Updated)},
+		{"Not Before", formatTime(bundle.NotBefore)},
+		{"Expires", formatTime(bundle.Expires)},
+	}
+	switch bundle.Type {
+	case VaultTypeSecret:
+		fields = append(fields, [2]string{"Content Type", bundle.ContentType}, [2]string{"Size", fmt.Sprintf("%d bytes", len(bundle.Value))})
+	case VaultTypeKey:
+		if bundle.Key != nil {
+			fields = append(fields, [2]string{"Key Type", bundle.Key.Kty})
+			if bundle.Key.Crv != "" {
+				fields = append(fields, [2]string{"Curve", bundle.Key.Crv})
+			}
+		}
+	case VaultTypeCertificate:
+		if cert, err := x509.ParseCertificate(bundle.Value); err == nil {
+			thumbprint := sha1.Sum(bundle.Value)
+			fields = append(fields,
+				[2]string{"Subject", cert.Subject.String()},
+				[2]string{"Issuer", cert.Issuer.String()},
+				[2]string{"DNS Names", strings.Join(cert.DNSNames, ", ")},
+				[2]string{"Valid From", cert.NotBefore.UTC().Format(time.RFC3339)},
+				[2]string{"Valid Until", cert.NotAfter.UTC().Format(time.RFC3339)},
+				[2]string{"Thumbprint", strings.ToUpper(hex.EncodeToString(thumbprint[:]))})
+		}
+	}
+	var tags []string
+	for key, value := range bundle.Tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	fields = append(fields, [2]string{"Tags", strings.Join(tags, ", ")})
+
+	for _, field := range fields {
+		fmt.Fprintf(table, "%s:\t%s\n", field[0], field[1])
+	}
+	return table.Flush()
+}
+
+// adminEncrypt encrypts the standard input into an encrypted-file object with the public part of an RSA key
+func adminEncrypt(ctx context.Context, backend Backend, args []string, w io.Writer) error {
+	if args[0] != VaultTypeKey {
+		return fmt.Errorf("files can only be encrypted with a key, got %s", args[0])
+	}
+	bundle, err := adminObject(ctx, backend, args)
+	if err != nil {
+		return err
+	}
+	publicKey, err := jsonWebKeyPublicKey(bundle.Key)
+	if err != nil {
+		return fmt.Errorf("invalid key %s: %s", bundle.Name, err)
+	}
+	plaintext, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	content, err := encryptEnvelope(publicKey, bundle.Name, bundle.Version, plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// adminObject gets the object of the <type> <name> [version] arguments
+func adminObject(ctx context.Context, backend Backend, args []string) (*ObjectBundle, error) {
+	version := ""
+	if len(args) > 2 {
+		version = args[2]
+	}
+	return resolveObject(ctx, backend, args[0], args[1], version)
+}
+
+func formatEnabled(enabled *bool) string {
+	if enabled == nil {
+		return ""
+	}
+	return fmt.Sprintf("%t", *enabled)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,550 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// socket of the agent, in the mount directory
+	agentSocketName = "agent.sock"
+	// pid of the agent started by the driver, in the mount directory
+	agentPidName            = ".kv-agent.pid"
+	agentSocketPermission   = 0666
+	agentReady              = "ready"
+	agentStartTimeout       = 30 * time.Second
+	agentStopTimeout        = 5 * time.Second
+	agentMountCheckInterval = time.Minute
+	// the client is authenticated again after agentClientLifetime, pod identity tokens cannot be refreshed
+	agentClientLifetime = 30 * time.Minute
+	// directory of the state dir holding the pod tokens of the agents, refreshed on every publish
+	agentTokensDir = "tokens"
+)
+
+// key operations of the agent, named as in the Key Vault REST API
+const (
+	agentSign      = "sign"
+	agentVerify    = "verify"
+	agentWrapKey   = "wrapkey"
+	agentUnwrapKey = "unwrapkey"
+	agentEncrypt   = "encrypt"
+	agentDecrypt   = "decrypt"
+)
+
+// Agent serves the key operations of the keys of a volume over HTTP. The keys never leave
+// Key Vault, the operations are proxied with the identity of the volume.
+type Agent struct {
+	options  Option
+	vaultURL string
+	// keys served by the agent, by file name: the alias when set
+	keys map[string]agentKey
+
+	mutex       sync.Mutex
+	client      *kv.BaseClient
+	clientSince time.Time
+}
+
+// agentKey is a Key Vault key served by the agent, the current version when version is empty
+type agentKey struct {
+	name    string
+	version string
+}
+
+// agentRequest is the body of a key operation, as in the Key Vault REST API
+type agentRequest struct {
+	Algorithm string `json:"alg"`
+	// base64url encoded digest to sign, signature to verify or data to wrap, unwrap, encrypt or decrypt
+	Value string `json:"value"`
+	// base64url encoded digest of a verification
+	Digest string `json:"digest,omitempty"`
+}
+
+// newAgent authenticates with the credentials of options and checks every key of the volume can be read
+func newAgent(ctx context.Context, options Option) (*Agent, error) {
+	vaultURL, err := getVaultURL(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get vault")
+	}
+	agent := &Agent{options: options, vaultURL: *vaultURL, keys: map[string]agentKey{}}
+
+	objectNames := strings.Split(options.vaultObjectNames, objectsSep)
+	objectAliases := strings.Split(options.vaultObjectAliases, objectsSep)
+	objectVersions := strings.Split(options.vaultObjectVersions, objectsSep)
+	for i := range objectNames {
+		key := agentKey{name: objectNames[i]}
+		fileName := objectNames[i]
+		if options.vaultObjectAliases != "" && len(objectAliases) == len(objectNames) {
+			fileName = objectAliases[i]
+		}
+		if options.vaultObjectVersions != "" && len(objectVersions) == len(objectNames) {
+			key.version = objectVersions[i]
+		}
+		agent.keys[fileName] = key
+	}
+
+	backend, err := agent.backend()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range agent.keys {
+		if _, err := backend.GetKey(ctx, key.name, key.version); err != nil {
+			return nil, sanitisedError(err, VaultTypeKey, key.name, key.version)
+		}
+	}
+	return agent, nil
+}
+
+// backend returns the Key Vault backend of the agent, authenticated again once the client is too old
+func (agent *Agent) backend() (*KeyvaultBackend, error) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if agent.client == nil || time.Since(agent.clientSince) > agentClientLifetime {
+		if agent.client != nil {
+			agent.refreshTokens()
+		}
+		client, err := initializeKvClient(agent.options, agent.vaultURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get keyvaultClient")
+		}
+		agent.client = client
+		agent.clientSince = time.Now()
+	}
+	return &KeyvaultBackend{client: agent.client, vaultURL: agent.vaultURL}, nil
+}
+
+// refreshTokens sets the last pod tokens published for the volume, the ones read on start expire
+func (agent *Agent) refreshTokens() {
+	tokensPath := agentTokensPath(agent.options.stateDir, agent.options.dir)
+	content, err := ioutil.ReadFile(tokensPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		glog.Errorf("failed to read the pod tokens %s: %s", tokensPath, err)
+		return
+	}
+	applyPodTokens(&agent.options, string(content))
+	glog.V(2).Infof("agent: refreshed the pod tokens of %s", agent.options.dir)
+}
+
+// ServeHTTP serves GET /keys, GET /keys/<name> and POST /keys/<name>/<operation>
+func (agent *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if segments[0] != "keys" || len(segments) > 3 {
+		writeVaultError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("unknown path %s", r.URL.Path))
+		return
+	}
+	if len(segments) == 1 {
+		if r.Method != http.MethodGet {
+			writeVaultError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		var names []string
+		for name := range agent.keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": names})
+		return
+	}
+
+	key, ok := agent.keys[segments[1]]
+	if !ok {
+		writeVaultError(w, http.StatusNotFound, "KeyNotFound", fmt.Sprintf("key %s is not served by the agent", segments[1]))
+		return
+	}
+	backend, err := agent.backend()
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+
+	if len(segments) == 2 {
+		if r.Method != http.MethodGet {
+			writeVaultError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		bundle, err := backend.GetKey(r.Context(), key.name, key.version)
+		if err != nil {
+			writeAgentError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": bundle.Key})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeVaultError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+	var req agentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeVaultError(w, http.StatusBadRequest, "BadParameter", fmt.Sprintf("invalid request body: %s", err))
+		return
+	}
+	if req.Algorithm == "" || req.Value == "" {
+		writeVaultError(w, http.StatusBadRequest, "BadParameter", "alg and value must be set")
+		return
+	}
+
+	operation := segments[2]
+	glog.V(2).Infof("agent: %s with key %s (version: %s) and algorithm %s", operation, key.name, key.version, req.Algorithm)
+	result, err := agent.operate(r.Context(), backend, key, operation, req)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// operate proxies a key operation to Key Vault and returns the body of the response
+func (agent *Agent) operate(ctx context.Context, backend *KeyvaultBackend, key agentKey, operation string, req agentRequest) (interface{}, error) {
+	client := backend.client
+	parameters := kv.KeyOperationsParameters{Algorithm: kv.JSONWebKeyEncryptionAlgorithm(req.Algorithm), Value: &req.Value}
+	var result kv.KeyOperationResult
+	var err error
+	switch operation {
+	case agentSign:
+		result, err = client.Sign(ctx, agent.vaultURL, key.name, key.version, kv.KeySignParameters{Algorithm: kv.JSONWebKeySignatureAlgorithm(req.Algorithm), Value: &req.Value})
+	case agentVerify:
+		if req.Digest == "" {
+			return nil, &BackendError{StatusCode: http.StatusBadRequest, Message: "digest must be set"}
+		}
+		verified, err := client.Verify(ctx, agent.vaultURL, key.name, key.version, kv.KeyVerifyParameters{Algorithm: kv.JSONWebKeySignatureAlgorithm(req.Algorithm), Digest: &req.Digest, Signature: &req.Value})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"value": verified.Value != nil && *verified.Value}, nil
+	case agentWrapKey:
+		result, err = client.WrapKey(ctx, agent.vaultURL, key.name, key.version, parameters)
+	case agentUnwrapKey:
+		result, err = client.UnwrapKey(ctx, agent.vaultURL, key.name, key.version, parameters)
+	case agentEncrypt:
+		result, err = client.Encrypt(ctx, agent.vaultURL, key.name, key.version, parameters)
+	case agentDecrypt:
+		result, err = client.Decrypt(ctx, agent.vaultURL, key.name, key.version, parameters)
+	default:
+		return nil, &BackendError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("unknown operation %s", operation)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"kid": stringValue(result.Kid), "value": stringValue(result.Result)}, nil
+}
+
+// writeAgentError writes a Key Vault or agent error with its status code, 502 when Key Vault could not be reached
+func writeAgentError(w http.ResponseWriter, err error) {
+	statusCode := errorStatusCode(err)
+	if statusCode == 0 {
+		statusCode = http.StatusBadGateway
+	}
+	glog.Errorf("agent: %s", err)
+	writeVaultError(w, statusCode, strings.Replace(http.StatusText(statusCode), " ", "", -1), strings.Replace(err.Error(), "\\", " ", -1))
+}
+
+// serveAgent serves the agent of options on the sockets in options.dir until it is terminated:
+// the HTTP API with agent and the ssh-agent protocol with sshAgent. When the driver started
+// the agent, ready reports whether it serves and the agent stops once the volume is unmounted.
+func serveAgent(ctx context.Context, options Option, ready func(error)) int {
+	agent, err := newAgent(ctx, options)
+	var sockets []string
+	if options.agent {
+		sockets = append(sockets, agentSocketName)
+	}
+	if options.sshAgent {
+		sockets = append(sockets, sshAgentSocketName)
+	}
+	listeners := map[string]net.Listener{}
+	for _, socket := range sockets {
+		if err != nil {
+			break
+		}
+		listeners[socket], err = listenAgentSocket(options.dir, socket)
+	}
+	if err == nil && ready != nil {
+		err = ioutil.WriteFile(filepath.Join(options.dir, agentPidName), []byte(strconv.Itoa(os.Getpid())), 0600)
+	}
+	if ready != nil {
+		ready(err)
+	}
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return 1
+	}
+	defer func() {
+		for socket, listener := range listeners {
+			listener.Close()
+			if err := os.Remove(filepath.Join(options.dir, socket)); err != nil && !os.IsNotExist(err) {
+				glog.Warningf("failed to remove the agent socket %s: %s", socket, err)
+			}
+		}
+		if ready != nil {
+			_ = os.Remove(filepath.Join(options.dir, agentPidName))
+		}
+	}()
+
+	server := &http.Server{Handler: agent}
+	errs := make(chan error, len(listeners))
+	if listener, ok := listeners[agentSocketName]; ok {
+		go func() { errs <- server.Serve(listener) }()
+	}
+	if listener, ok := listeners[sshAgentSocketName]; ok {
+		go func() { errs <- (&SSHAgent{agent: agent}).serve(listener) }()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var unmounted <-chan time.Time
+	if ready != nil {
+		ticker := time.NewTicker(agentMountCheckInterval)
+		defer ticker.Stop()
+		unmounted = ticker.C
+	}
+
+	glog.Infof("starting the %s %s agent for %d keys on %s: %s", program, version, len(agent.keys), options.dir, strings.Join(sockets, ", "))
+	for {
+		select {
+		case err := <-errs:
+			glog.Errorf("[error] : %s", err)
+			return 1
+		case sig := <-signals:
+			glog.Infof("received %s, stopping", sig)
+			_ = server.Close()
+			return 0
+		case <-unmounted:
+			if mounted, err := isMounted(options.dir); err == nil && !mounted {
+				glog.Infof("%s is not mounted anymore, stopping", options.dir)
+				_ = server.Close()
+				return 0
+			}
+		}
+	}
+}
+
+// listenAgentSocket listens on a socket of dir, replacing a stale socket
+func listenAgentSocket(dir, socket string) (net.Listener, error) {
+	socketPath := filepath.Join(dir, socket)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to remove stale socket %s", socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", socketPath)
+	}
+	// the containers of the pod can run as any user
+	if err := os.Chmod(socketPath, agentSocketPermission); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "failed to set the permission of %s", socketPath)
+	}
+	return listener, nil
+}
+
+// runAgent is the agent subcommand, started by the driver for a volume with the agent or sshagent option.
+// It reads the options of the volume as JSON on stdin and reports it serves on file descriptor 3.
+func runAgent(args []string) int {
+	var dir string
+	var node NodeOptions
+	flag.StringVar(&dir, "dir", "", "Mount directory of the volume.")
+	registerNodeFlags(flag.CommandLine, &node)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+	setupDriverLogging()
+	defer glog.Flush()
+
+	readyFile := os.NewFile(3, "ready")
+	ready := func(err error) {
+		status := agentReady
+		if err != nil {
+			status = strings.Replace(err.Error(), "\\", " ", -1)
+		}
+		if _, err := readyFile.WriteString(status); err != nil {
+			glog.Warningf("failed to report the agent status: %s", err)
+		}
+		readyFile.Close()
+	}
+
+	options, err := agentVolumeOptions(dir, node)
+	if err != nil {
+		ready(err)
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	return serveAgent(context.Background(), *options, ready)
+}
+
+// agentVolumeOptions reads the options of the volume on stdin
+func agentVolumeOptions(dir string, node NodeOptions) (*Option, error) {
+	var volume agentVolume
+	if err := json.NewDecoder(os.Stdin).Decode(&volume); err != nil {
+		return nil, errors.Wrap(err, "failed to read the volume options")
+	}
+	options, err := optionsFromParams(volume.Params, node)
+	if err != nil {
+		return nil, err
+	}
+	options.dir = dir
+	applyPodTokens(options, volume.Tokens)
+	if err := Validate(*options); err != nil {
+		return nil, err
+	}
+	if err := configureHTTPClient(options.transport); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// agentVolume is the volume sent to an agent on stdin
+type agentVolume struct {
+	Params map[string]string `json:"params"`
+	// service account tokens of the pod, in the format of the CSI volume attributes
+	Tokens string `json:"tokens,omitempty"`
+}
+
+// agentTokensPath returns the path of the pod tokens of the agent of dir in stateDir, out of the volume
+func agentTokensPath(stateDir, dir string) string {
+	return filepath.Join(stateDir, agentTokensDir, fmt.Sprintf("%x", sha256.Sum256([]byte(filepath.Clean(dir)))))
+}
+
+// writeAgentTokens stores the pod tokens of a publish of dir, for its agent to authenticate again
+func writeAgentTokens(stateDir, dir, tokens string) error {
+	tokensPath := agentTokensPath(stateDir, dir)
+	if err := os.MkdirAll(filepath.Dir(tokensPath), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create the directory of the pod tokens %s", tokensPath)
+	}
+	if err := ioutil.WriteFile(tokensPath, []byte(tokens), 0600); err != nil {
+		return errors.Wrapf(err, "failed to write the pod tokens %s", tokensPath)
+	}
+	return nil
+}
+
+// removeAgentTokens removes the pod tokens of dir, once its agent is stopped
+func removeAgentTokens(stateDir, dir string) {
+	if err := os.Remove(agentTokensPath(stateDir, dir)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove the pod tokens of %s: %s", dir, err)
+	}
+}
+
+// startAgent starts the agent of the volume at dir in the background and waits until it serves.
+// The options are sent on stdin, the command line of a process is readable by every user of the node.
+func startAgent(dir string, params map[string]string, tokens string, node NodeOptions) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find the driver executable")
+	}
+	content, err := json.Marshal(agentVolume{Params: params, Tokens: tokens})
+	if err != nil {
+		return err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	// the kubelet waits for the output of a flexVolume call to be closed, the agent must not inherit it
+	cmd := exec.Command(executable, append([]string{"agent", "-dir", dir}, node.args()...)...)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = detachedProcess()
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to start the agent")
+	}
+
+	if err := readyReader.SetReadDeadline(time.Now().Add(agentStartTimeout)); err != nil {
+		glog.Warningf("failed to set the agent start timeout: %s", err)
+	}
+	status, err := ioutil.ReadAll(readyReader)
+	if err != nil || string(status) != agentReady {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if err != nil {
+			return errors.Wrap(err, "the agent did not start")
+		}
+		return fmt.Errorf("the agent failed to start: %s", status)
+	}
+	// reaps the agent when it exits before the driver
+	go func() { _ = cmd.Wait() }()
+	glog.V(0).Infof("started the agent of %s with pid %d", dir, cmd.Process.Pid)
+	return nil
+}
+
+// stopAgent terminates the agent of the volume at dir, if any
+func stopAgent(dir string) {
+	pidPath := filepath.Join(dir, agentPidName)
+	content, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err == nil && isAgentProcess(pid, dir) {
+		process, _ := os.FindProcess(pid)
+		if err := process.Signal(syscall.SIGTERM); err == nil {
+			for deadline := time.Now().Add(agentStopTimeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+				if process.Signal(syscall.Signal(0)) != nil {
+					break
+				}
+			}
+			glog.V(0).Infof("stopped the agent of %s with pid %d", dir, pid)
+		}
+	}
+	for _, name := range []string{agentPidName, agentSocketName, sshAgentSocketName} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to remove %s: %s", name, err)
+		}
+	}
+}
+
+// isAgentProcess checks pid is the agent of dir, the pid of an agent that exited may have been reused
+func isAgentProcess(pid int, dir string) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	return len(args) > 3 && args[1] == "agent" && args[2] == "-dir" && args[3] == dir
+}
+
+// transportArgs returns the flags of transport
+func transportArgs(transport TransportOptions) []string {
+	return []string{
+		"-httpTimeout=" + transport.Timeout.String(),
+		"-httpDialTimeout=" + transport.DialTimeout.String(),
+		"-httpTLSHandshakeTimeout=" + transport.TLSHandshakeTimeout.String(),
+		"-httpKeepAlive=" + transport.KeepAlive.String(),
+		"-httpIdleConnTimeout=" + transport.IdleConnTimeout.String(),
+		"-caBundle=" + transport.CABundle,
+		"-httpsProxy=" + transport.HTTPSProxy,
+		"-noProxy=" + transport.NoProxy,
+	}
+}
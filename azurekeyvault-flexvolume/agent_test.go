@@ -0,0 +1,170 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testKeyPEM returns the PKCS #8 PEM encoding of a private key, as in a fixture
+func testKeyPEM(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestAgentServeHTTP(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator := startTestEmulator(t, FileFixture{Keys: []FileObject{
+		{Name: "signing", Version: "1", PEM: testKeyPEM(t, key)},
+		{Name: "other", Version: "1", PEM: testKeyPEM(t, key)},
+	}}, nil)
+	defer emulator.stop()
+	options := emulator.options()
+	options.vaultObjectNames = "signing"
+	options.vaultObjectAliases = "web"
+	options.vaultObjectTypes = VaultTypeKey
+	agent, err := newAgent(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("payload"))
+	encodedDigest := base64.RawURLEncoding.EncodeToString(digest[:])
+	serve := func(method, path, body string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		agent.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var resp map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s returned %s", method, path, w.Body.String())
+		}
+		return w.Code, resp
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{name: "list", method: "GET", path: "/keys", want: http.StatusOK},
+		{name: "list with another method", method: "POST", path: "/keys", want: http.StatusMethodNotAllowed},
+		{name: "key", method: "GET", path: "/keys/web", want: http.StatusOK},
+		{name: "key with another method", method: "DELETE", path: "/keys/web", want: http.StatusMethodNotAllowed},
+		{name: "key by name instead of alias", method: "GET", path: "/keys/signing", want: http.StatusNotFound},
+		{name: "key not served", method: "GET", path: "/keys/other", want: http.StatusNotFound},
+		{name: "unknown path", method: "GET", path: "/secrets", want: http.StatusNotFound},
+		{name: "path too long", method: "POST", path: "/keys/web/sign/more", want: http.StatusNotFound},
+		{name: "operation with another method", method: "GET", path: "/keys/web/sign", want: http.StatusMethodNotAllowed},
+		{name: "invalid body", method: "POST", path: "/keys/web/sign", body: "{", want: http.StatusBadRequest},
+		{name: "no algorithm", method: "POST", path: "/keys/web/sign", body: `{"value": "` + encodedDigest + `"}`, want: http.StatusBadRequest},
+		{name: "unknown operation", method: "POST", path: "/keys/web/export", body: `{"alg": "RS256", "value": "` + encodedDigest + `"}`, want: http.StatusNotFound},
+		{name: "verify without digest", method: "POST", path: "/keys/web/verify", body: `{"alg": "RS256", "value": "c2ln"}`, want: http.StatusBadRequest},
+		{name: "error of key vault", method: "POST", path: "/keys/web/sign", body: `{"alg": "RS256", "value": "c2hvcnQ"}`, want: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, resp := serve(test.method, test.path, test.body)
+			if code != test.want {
+				t.Errorf("%s %s = %d %v, want %d", test.method, test.path, code, resp, test.want)
+			}
+		})
+	}
+
+	if _, resp := serve("GET", "/keys", ""); len(resp["keys"].([]interface{})) != 1 || resp["keys"].([]interface{})[0] != "web" {
+		t.Errorf("keys = %v, want the alias of the key", resp["keys"])
+	}
+	if _, resp := serve("GET", "/keys/web", ""); resp["key"].(map[string]interface{})["kty"] != "RSA" {
+		t.Errorf("key = %v, want the public RSA key", resp["key"])
+	}
+
+	code, resp := serve("POST", "/keys/web/sign", `{"alg": "RS256", "value": "`+encodedDigest+`"}`)
+	if code != http.StatusOK {
+		t.Fatalf("sign = %d %v", code, resp)
+	}
+	encodedSignature := resp["value"].(string)
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("the signature of the agent is invalid: %s", err)
+	}
+	for digest, want := range map[string]bool{encodedDigest: true, base64.RawURLEncoding.EncodeToString(make([]byte, 32)): false} {
+		_, resp := serve("POST", "/keys/web/verify", `{"alg": "RS256", "digest": "`+digest+`", "value": "`+encodedSignature+`"}`)
+		if resp["value"] != want {
+			t.Errorf("verify = %v, want %v", resp, want)
+		}
+	}
+
+	// the errors of key vault are returned with their status code
+	emulator.forbidden[VaultTypeKey+"/signing"] = true
+	if code, resp := serve("POST", "/keys/web/sign", `{"alg": "RS256", "value": "`+encodedDigest+`"}`); code != http.StatusForbidden {
+		t.Errorf("sign of a forbidden key = %d %v, want %d", code, resp, http.StatusForbidden)
+	}
+}
+
+func TestAgentRefreshTokens(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "kv-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+	agent := &Agent{options: Option{dir: "/kvmnt", stateDir: stateDir}}
+	applyPodTokens(&agent.options, `{"api://AzureADTokenExchange": {"token": "published"}}`)
+
+	// without a republish, the tokens read on start are kept
+	agent.refreshTokens()
+	if agent.options.federatedToken != "published" {
+		t.Fatalf("federatedToken = %q without republished tokens", agent.options.federatedToken)
+	}
+
+	if err := writeAgentTokens(stateDir, "/kvmnt/", `{"api://AzureADTokenExchange": {"token": "republished"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAgentTokens(stateDir, "/other", `{"api://AzureADTokenExchange": {"token": "other"}}`); err != nil {
+		t.Fatal(err)
+	}
+	agent.refreshTokens()
+	if agent.options.federatedToken != "republished" {
+		t.Errorf("federatedToken = %q, want the republished token of the volume", agent.options.federatedToken)
+	}
+	info, err := os.Stat(agentTokensPath(stateDir, "/kvmnt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the pod tokens have the permission %s", info.Mode().Perm())
+	}
+
+	removeAgentTokens(stateDir, "/kvmnt")
+	if _, err := os.Stat(agentTokensPath(stateDir, "/kvmnt")); !os.IsNotExist(err) {
+		t.Errorf("the pod tokens are not removed: %v", err)
+	}
+	if _, err := os.Stat(agentTokensPath(stateDir, "/other")); err != nil {
+		t.Errorf("the pod tokens of another volume are removed: %s", err)
+	}
+}
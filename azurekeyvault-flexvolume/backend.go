@@ -0,0 +1,225 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Providers of the objects, selected with -provider
+const (
+	// ProviderAzure fetches the objects from Azure Key Vault
+	ProviderAzure = "azure"
+	// ProviderVault fetches the objects from HashiCorp Vault
+	ProviderVault = "vault"
+	// ProviderFile fetches the objects from a node-local directory tree or fixture file
+	ProviderFile = "file"
+)
+
+// Backend retrieves the objects of a secret store. The objects are identified by their type,
+// secret, key or cert, their name and an optional version, empty for the current version.
+type Backend interface {
+	// GetSecret returns the value of a secret
+	GetSecret(ctx context.Context, name, version string) (*ObjectBundle, error)
+	// GetKey returns the public part of a key
+	GetKey(ctx context.Context, name, version string) (*ObjectBundle, error)
+	// GetCertificate returns the DER encoded certificate
+	GetCertificate(ctx context.Context, name, version string) (*ObjectBundle, error)
+	// List returns the objects of a type, without their content
+	List(ctx context.Context, objectType string) ([]ObjectItem, error)
+	// Versions returns the versions of an object, without their content
+	Versions(ctx context.Context, objectType, name string) ([]ObjectItem, error)
+}
+
+// backends maps the providers to the constructors of their backend
+var backends = map[string]func(ctx context.Context, options Option) (Backend, error){
+	ProviderAzure: newKeyvaultBackend,
+	ProviderVault: newVaultBackend,
+	ProviderFile:  newFileBackend,
+}
+
+// ObjectItem describes an object or one of its versions
+type ObjectItem struct {
+	Type    string
+	Name    string
+	Version string
+	// nil when the backend does not report it
+	Enabled   *bool
+	Created   *time.Time
+	Updated   *time.Time
+	NotBefore *time.Time
+	Expires   *time.Time
+	Tags      map[string]string
+}
+
+// ObjectBundle is an object and its content
+type ObjectBundle struct {
+	ObjectItem
+	// the value of a secret or the DER encoded certificate
+	Value []byte
+	// the public part of a key
+	Key *JSONWebKey
+	// the content type of a secret, if any
+	ContentType string
+}
+
+// JSONWebKey is the public part of a key, with base64url encoded parameters
+type JSONWebKey struct {
+	Kid string `json:"kid,omitempty"`
+	Kty string `json:"kty,omitempty"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC curve and coordinates
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// BackendError is an error of a backend with the HTTP status code it maps to, e.g. 404 for missing objects
+type BackendError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *BackendError) Error() string {
+	return err.Message
+}
+
+// newBackend returns the backend of the provider selected in options
+func newBackend(ctx context.Context, options Option) (Backend, error) {
+	constructor, ok := backends[options.provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, should be one of %s", options.provider, strings.Join(backendNames(), ", "))
+	}
+	return constructor(ctx, options)
+}
+
+// backendNames returns the sorted names of the providers
+func backendNames() []string {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getObject returns an object of any type from backend
+func getObject(ctx context.Context, backend Backend, objectType, name, version string) (*ObjectBundle, error) {
+	switch objectType {
+	case VaultTypeSecret:
+		return backend.GetSecret(ctx, name, version)
+	case VaultTypeKey:
+		return backend.GetKey(ctx, name, version)
+	case VaultTypeCertificate:
+		return backend.GetCertificate(ctx, name, version)
+	case VaultTypeEncryptedFile:
+		// the version of the key is in the header of the file
+		return getEncryptedFile(ctx, backend, name)
+	default:
+		return nil, fmt.Errorf("Invalid vaultObjectTypes. Should be secret, key, cert, or encrypted-file")
+	}
+}
+
+// resolveObject returns an object of backend. Without version, when the current version is disabled,
+// not yet valid or expired, it falls back to the newest version that is enabled and valid now. When
+// there is none, the current version is returned for the expiry policy to decide. A disabled version
+// is an error, as with Key Vault.
+func resolveObject(ctx context.Context, backend Backend, objectType, name, version string) (*ObjectBundle, error) {
+	if version != "" || objectType == VaultTypeEncryptedFile {
+		return getEnabledObject(ctx, backend, objectType, name, version)
+	}
+	now := time.Now()
+	current, err := getEnabledObject(ctx, backend, objectType, name, "")
+	if err == nil && isActive(current.ObjectItem, now) {
+		return current, nil
+	}
+	// Key Vault forbids reading disabled objects
+	if err != nil && !isDisabledError(err) {
+		return nil, err
+	}
+
+	items, listErr := backend.Versions(ctx, objectType, name)
+	if listErr != nil {
+		glog.Warningf("failed to list the versions of %s %s to find an active one: %s", objectType, name, listErr)
+		return current, err
+	}
+	// newest first, the versions without creation time last
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Created == nil || items[j].Created == nil {
+			return items[i].Created != nil
+		}
+		return items[i].Created.After(*items[j].Created)
+	})
+	for _, item := range items {
+		if current != nil && item.Version == current.Version {
+			continue
+		}
+		if !isActive(item, now) {
+			continue
+		}
+		glog.Warningf("the current version of %s %s is not active, using version %s", objectType, name, item.Version)
+		return getEnabledObject(ctx, backend, objectType, name, item.Version)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "no version of %s %s is active", objectType, name)
+	}
+	return current, nil
+}
+
+// getEnabledObject returns an object of backend, or the error of Key Vault when it is disabled
+func getEnabledObject(ctx context.Context, backend Backend, objectType, name, version string) (*ObjectBundle, error) {
+	bundle, err := getObject(ctx, backend, objectType, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Enabled != nil && !*bundle.Enabled {
+		return nil, &BackendError{StatusCode: http.StatusForbidden, Message: fmt.Sprintf("Operation get is not allowed on a disabled %s.", objectType)}
+	}
+	return bundle, nil
+}
+
+// isActive returns true when an object version is enabled and valid at now
+func isActive(item ObjectItem, now time.Time) bool {
+	if item.Enabled != nil && !*item.Enabled {
+		return false
+	}
+	if item.NotBefore != nil && now.Before(*item.NotBefore) {
+		return false
+	}
+	if item.Expires != nil && !now.Before(*item.Expires) {
+		return false
+	}
+	return true
+}
+
+// isDisabledError returns true for the errors of Key Vault when reading a disabled object
+func isDisabledError(err error) bool {
+	return errorStatusCode(err) == http.StatusForbidden && strings.Contains(strings.ToLower(err.Error()), "disabled")
+}
+
+// formatObject returns the content written for an object
+func formatObject(object *ObjectBundle) ([]byte, error) {
+	switch object.Type {
+	case VaultTypeKey:
+		// NOTE: we are writing the RSA modulus content of the key
+		if object.Key == nil {
+			return nil, fmt.Errorf("key %s has no public key", object.Name)
+		}
+		return []byte(object.Key.N), nil
+	default:
+		return object.Value, nil
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestResolveObject(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	disabled := false
+
+	tests := []struct {
+		name     string
+		versions []FileObject
+		version  string
+		// the version resolved, none for an error
+		want string
+		// a part of the expected error
+		wantError string
+	}{
+		{
+			name:     "current version active",
+			versions: []FileObject{{Version: "1", Created: at(-2 * time.Hour)}, {Version: "2", Created: at(-time.Hour)}},
+			want:     "2",
+		},
+		{
+			name:     "pinned version",
+			versions: []FileObject{{Version: "1", Created: at(-2 * time.Hour)}, {Version: "2", Created: at(-time.Hour)}},
+			version:  "1",
+			want:     "1",
+		},
+		{
+			name:      "pinned disabled version",
+			versions:  []FileObject{{Version: "1", Created: at(-2 * time.Hour), Enabled: &disabled}, {Version: "2", Created: at(-time.Hour)}},
+			version:   "1",
+			wantError: "disabled",
+		},
+		{
+			name:      "pinned version not found",
+			versions:  []FileObject{{Version: "1"}},
+			version:   "3",
+			wantError: "not found",
+		},
+		{
+			name: "current version disabled",
+			versions: []FileObject{
+				{Version: "1", Created: at(-3 * time.Hour)},
+				{Version: "2", Created: at(-2 * time.Hour)},
+				{Version: "3", Created: at(-time.Hour), Enabled: &disabled},
+			},
+			want: "2",
+		},
+		{
+			name: "current version not yet valid",
+			versions: []FileObject{
+				{Version: "1", Created: at(-2 * time.Hour)},
+				{Version: "2", Created: at(-time.Hour), NotBefore: at(time.Hour)},
+			},
+			want: "1",
+		},
+		{
+			name: "current version expired",
+			versions: []FileObject{
+				{Version: "1", Created: at(-2 * time.Hour), Expires: at(time.Hour)},
+				{Version: "2", Created: at(-time.Hour), Expires: at(-time.Minute)},
+			},
+			want: "1",
+		},
+		{
+			name: "newest active version by creation time",
+			versions: []FileObject{
+				{Version: "b", Created: at(-time.Hour)},
+				{Version: "a", Created: at(-3 * time.Hour)},
+				{Version: "c"},
+				{Version: "d", Created: at(-2 * time.Hour), Enabled: &disabled},
+				{Version: "e", Created: at(-time.Minute), Expires: at(-time.Second)},
+			},
+			want: "b",
+		},
+		{
+			name: "no other version active",
+			versions: []FileObject{
+				{Version: "1", Created: at(-2 * time.Hour), Enabled: &disabled},
+				{Version: "2", Created: at(-time.Hour), Expires: at(-time.Minute)},
+			},
+			// the expiry policy decides
+			want: "2",
+		},
+		{
+			name: "no version active",
+			versions: []FileObject{
+				{Version: "1", Created: at(-2 * time.Hour), Expires: at(-time.Hour)},
+				{Version: "2", Created: at(-time.Hour), Enabled: &disabled},
+			},
+			wantError: "no version of secret db-password is active",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &FileBackend{objects: map[string]map[string][]FileObject{}}
+			for _, object := range test.versions {
+				object.Name = "db-password"
+				object.Value = "value " + object.Version
+				backend.add(VaultTypeSecret, object)
+			}
+			bundle, err := resolveObject(context.Background(), backend, VaultTypeSecret, "db-password", test.version)
+			if test.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantError) {
+					t.Errorf("error = %v, want %q", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bundle.Version != test.want || string(bundle.Value) != "value "+test.want {
+				t.Errorf("version = %s, want %s", bundle.Version, test.want)
+			}
+		})
+	}
+}
+
+func TestIsActive(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+	enabled, disabled := true, false
+
+	tests := []struct {
+		name string
+		item ObjectItem
+		want bool
+	}{
+		{name: "no attributes", item: ObjectItem{}, want: true},
+		{name: "enabled and valid", item: ObjectItem{Enabled: &enabled, NotBefore: &before, Expires: &after}, want: true},
+		{name: "disabled", item: ObjectItem{Enabled: &disabled}},
+		{name: "not yet valid", item: ObjectItem{NotBefore: &after}},
+		{name: "valid from now", item: ObjectItem{NotBefore: &now}, want: true},
+		{name: "expired", item: ObjectItem{Expires: &before}},
+		{name: "expires now", item: ObjectItem{Expires: &now}},
+	}
+	for _, test := range tests {
+		if got := isActive(test.item, now); got != test.want {
+			t.Errorf("%s: isActive = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIsDisabledError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &BackendError{StatusCode: http.StatusForbidden, Message: "Operation get is not allowed on a disabled secret."}, want: true},
+		{err: errors.Wrap(&BackendError{StatusCode: http.StatusForbidden, Message: "Operation get is not allowed on a Disabled key."}, "failed to get key"), want: true},
+		{err: &BackendError{StatusCode: http.StatusForbidden, Message: "The user, group or application does not have secrets get permission on key vault"}},
+		{err: &BackendError{StatusCode: http.StatusNotFound, Message: "secret disabled not found"}},
+		{err: fmt.Errorf("secret is disabled")},
+	}
+	for _, test := range tests {
+		if got := isDisabledError(test.err); got != test.want {
+			t.Errorf("isDisabledError(%q) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	challengeAPIVersion = "2016-10-01"
+	bearerScheme        = "Bearer"
+)
+
+var challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// aadAuthorityHosts are the AAD hosts of the public and sovereign clouds, accepted as challenge
+// authorities along with the AAD host of the configured environment
+var aadAuthorityHosts = []string{
+	"login.microsoftonline.com",
+	"login.windows.net",
+	"login.microsoftonline.us",
+	"login.chinacloudapi.cn",
+	"login.microsoftonline.de",
+}
+
+// BearerChallenge is the authority and resource Key Vault advertises in the
+// WWW-Authenticate header of unauthenticated requests
+type BearerChallenge struct {
+	// the AAD endpoint of the authority, e.g. https://login.windows.net/
+	ActiveDirectoryEndpoint string
+	// the tenant the vault belongs to
+	TenantID string
+	// the resource to request tokens for, e.g. https://vault.azure.net
+	Resource string
+}
+
+// discoverBearerChallenge makes an unauthenticated request to the vault and parses its 401 challenge.
+// The authority must be a known AAD host or the AAD host of env. When explicitURL is set, the resource
+// must be the one of env, otherwise the vault host must belong to the domain of the advertised resource.
+func discoverBearerChallenge(vaultURL string, env *azure.Environment, explicitURL bool) (*BearerChallenge, error) {
+	endpoint := fmt.Sprintf("%ssecrets?api-version=%s", vaultURL, challengeAPIVersion)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to probe key vault for its authentication challenge")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			glog.Warning("failed to close key vault challenge response body")
+		}
+	}()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, fmt.Errorf("key vault challenge probe returned status code %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	challenge, err := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := challenge.verify(vaultURL, env, explicitURL); err != nil {
+		return nil, err
+	}
+
+	glog.V(2).Infof("azure: discovered tenant %s and resource %s from key vault challenge", challenge.TenantID, challenge.Resource)
+	return challenge, nil
+}
+
+// parseBearerChallenge parses a header such as
+// Bearer authorization="https://login.windows.net/<tenant>", resource="https://vault.azure.net"
+func parseBearerChallenge(header string) (*BearerChallenge, error) {
+	if !strings.HasPrefix(header, bearerScheme+" ") {
+		return nil, fmt.Errorf("key vault did not return a bearer challenge: %q", header)
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParamRegexp.FindAllStringSubmatch(header[len(bearerScheme)+1:], -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	authority := params["authorization"]
+	if authority == "" {
+		authority = params["authorization_uri"]
+	}
+	authorityURL, err := url.Parse(authority)
+	if err != nil || authorityURL.Scheme != "https" || authorityURL.Host == "" {
+		return nil, fmt.Errorf("invalid authority %q in key vault challenge", authority)
+	}
+	tenantID := path.Base(strings.TrimSuffix(authorityURL.Path, "/"))
+	if tenantID == "" || tenantID == "." || tenantID == "/" {
+		return nil, fmt.Errorf("no tenant in authority %q of key vault challenge", authority)
+	}
+
+	resource := params["resource"]
+	if resource == "" {
+		// newer vaults advertise a scope instead of a resource
+		resource = strings.TrimSuffix(params["scope"], "/.default")
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("no resource in key vault challenge: %q", header)
+	}
+
+	return &BearerChallenge{
+		ActiveDirectoryEndpoint: fmt.Sprintf("%s://%s/", authorityURL.Scheme, authorityURL.Host),
+		TenantID:                tenantID,
+		Resource:                strings.TrimSuffix(resource, "/"),
+	}, nil
+}
+
+// verify checks the authority and the resource of the challenge against env and the vault
+func (challenge *BearerChallenge) verify(vaultURL string, env *azure.Environment, explicitURL bool) error {
+	authority, err := url.Parse(challenge.ActiveDirectoryEndpoint)
+	if err != nil {
+		return err
+	}
+	if !isTrustedAuthority(authority.Hostname(), env) {
+		return fmt.Errorf("key vault challenge authority %s is not a known AAD host", challenge.ActiveDirectoryEndpoint)
+	}
+
+	// an explicit URL keeps the resource of the cloud environment
+	if explicitURL {
+		if !strings.EqualFold(challenge.Resource, getKeyvaultResource(env)) {
+			return fmt.Errorf("key vault challenge resource %s does not match resource %s of the cloud environment", challenge.Resource, getKeyvaultResource(env))
+		}
+		return nil
+	}
+
+	vault, err := url.Parse(vaultURL)
+	if err != nil {
+		return err
+	}
+	resource, err := url.Parse(challenge.Resource)
+	if err != nil {
+		return errors.Wrapf(err, "invalid resource %s in key vault challenge", challenge.Resource)
+	}
+	if resource.Scheme != "https" || !strings.HasSuffix(vault.Hostname(), "."+resource.Hostname()) {
+		return fmt.Errorf("key vault challenge resource %s does not match vault host %s", challenge.Resource, vault.Hostname())
+	}
+	return nil
+}
+
+// isTrustedAuthority returns true for the known AAD hosts and the AAD host of env
+func isTrustedAuthority(host string, env *azure.Environment) bool {
+	if configured, err := url.Parse(env.ActiveDirectoryEndpoint); err == nil && strings.EqualFold(host, configured.Hostname()) {
+		return true
+	}
+	for _, known := range aadAuthorityHosts {
+		if strings.EqualFold(host, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTo returns a copy of env using the authority of the challenge, and its resource unless
+// the vault URL is explicit
+func (challenge *BearerChallenge) applyTo(env *azure.Environment, explicitURL bool) *azure.Environment {
+	discovered := *env
+	discovered.ActiveDirectoryEndpoint = challenge.ActiveDirectoryEndpoint
+	if !explicitURL {
+		discovered.ResourceIdentifiers.KeyVault = challenge.Resource
+	}
+	return &discovered
+}
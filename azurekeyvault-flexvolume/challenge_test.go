@@ -0,0 +1,223 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   BearerChallenge
+		// a part of the expected error, empty when the header is valid
+		wantErr string
+	}{
+		{
+			name:   "authorization and resource",
+			header: `Bearer authorization="https://login.windows.net/72f988bf-86f1-41af-91ab-2d7cd011db47", resource="https://vault.azure.net"`,
+			want:   BearerChallenge{ActiveDirectoryEndpoint: "https://login.windows.net/", TenantID: "72f988bf-86f1-41af-91ab-2d7cd011db47", Resource: "https://vault.azure.net"},
+		},
+		{
+			name:   "authorization_uri and scope",
+			header: `Bearer authorization_uri="https://login.microsoftonline.com/tenant/", scope="https://vault.azure.net/.default"`,
+			want:   BearerChallenge{ActiveDirectoryEndpoint: "https://login.microsoftonline.com/", TenantID: "tenant", Resource: "https://vault.azure.net"},
+		},
+		{
+			name:   "authorization takes precedence",
+			header: `Bearer authorization_uri="https://login.microsoftonline.com/other", authorization="https://login.windows.net/tenant", resource="https://vault.azure.net/"`,
+			want:   BearerChallenge{ActiveDirectoryEndpoint: "https://login.windows.net/", TenantID: "tenant", Resource: "https://vault.azure.net"},
+		},
+		{
+			name:   "resource takes precedence over scope",
+			header: `Bearer authorization="https://login.windows.net/tenant", scope="https://other.net/.default", resource="https://vault.azure.net"`,
+			want:   BearerChallenge{ActiveDirectoryEndpoint: "https://login.windows.net/", TenantID: "tenant", Resource: "https://vault.azure.net"},
+		},
+		{
+			name:    "missing header",
+			header:  "",
+			wantErr: "did not return a bearer challenge",
+		},
+		{
+			name:    "other scheme",
+			header:  `Basic realm="vault"`,
+			wantErr: "did not return a bearer challenge",
+		},
+		{
+			name:    "no authority",
+			header:  `Bearer resource="https://vault.azure.net"`,
+			wantErr: "invalid authority",
+		},
+		{
+			name:    "http authority",
+			header:  `Bearer authorization="http://login.windows.net/tenant", resource="https://vault.azure.net"`,
+			wantErr: "invalid authority",
+		},
+		{
+			name:    "authority without host",
+			header:  `Bearer authorization="https:///tenant", resource="https://vault.azure.net"`,
+			wantErr: "invalid authority",
+		},
+		{
+			name:    "authority without tenant",
+			header:  `Bearer authorization="https://login.windows.net/", resource="https://vault.azure.net"`,
+			wantErr: "no tenant",
+		},
+		{
+			name:    "no resource",
+			header:  `Bearer authorization="https://login.windows.net/tenant"`,
+			wantErr: "no resource",
+		},
+		{
+			name:    "unquoted params",
+			header:  `Bearer authorization=https://login.windows.net/tenant, resource=https://vault.azure.net`,
+			wantErr: "invalid authority",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge, err := parseBearerChallenge(test.header)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *challenge != test.want {
+				t.Errorf("challenge = %+v, want %+v", *challenge, test.want)
+			}
+		})
+	}
+}
+
+func TestBearerChallengeVerify(t *testing.T) {
+	stack := azure.PublicCloud
+	stack.ActiveDirectoryEndpoint = "https://adfs.local.azurestack.external/adfs/"
+	stack.ResourceIdentifiers.KeyVault = "https://vault.local.azurestack.external"
+
+	tests := []struct {
+		name        string
+		authority   string
+		resource    string
+		vaultURL    string
+		env         azure.Environment
+		explicitURL bool
+		// a part of the expected error, empty when the challenge is trusted
+		wantErr string
+	}{
+		{
+			name:      "public cloud",
+			authority: "https://login.windows.net/", resource: "https://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+		},
+		{
+			name:      "sovereign cloud authority",
+			authority: "https://login.chinacloudapi.cn/", resource: "https://vault.azure.cn",
+			vaultURL: "https://testvault.vault.azure.cn/", env: azure.PublicCloud,
+		},
+		{
+			name:      "authority of the environment",
+			authority: "https://adfs.local.azurestack.external/", resource: "https://vault.local.azurestack.external",
+			vaultURL: "https://testvault.vault.local.azurestack.external/", env: stack,
+		},
+		{
+			name:      "authority case",
+			authority: "https://LOGIN.windows.net/", resource: "https://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+		},
+		{
+			name:      "foreign authority",
+			authority: "https://login.attacker.com/", resource: "https://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+			wantErr: "not a known AAD host",
+		},
+		{
+			name:      "authority with a known host as prefix",
+			authority: "https://login.microsoftonline.com.attacker.com/", resource: "https://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+			wantErr: "not a known AAD host",
+		},
+		{
+			name:      "authority of another environment",
+			authority: "https://adfs.local.azurestack.external/", resource: "https://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+			wantErr: "not a known AAD host",
+		},
+		{
+			name:      "vault outside of the resource",
+			authority: "https://login.windows.net/", resource: "https://attacker.com",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+			wantErr: "does not match vault host",
+		},
+		{
+			name:      "vault host ending with the resource without a dot",
+			authority: "https://login.windows.net/", resource: "https://azure.net",
+			vaultURL: "https://testvault.attackerazure.net/", env: azure.PublicCloud,
+			wantErr: "does not match vault host",
+		},
+		{
+			name:      "vault host with the resource as prefix",
+			authority: "https://login.windows.net/", resource: "https://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net.attacker.com/", env: azure.PublicCloud,
+			wantErr: "does not match vault host",
+		},
+		{
+			name:      "http resource",
+			authority: "https://login.windows.net/", resource: "http://vault.azure.net",
+			vaultURL: "https://testvault.vault.azure.net/", env: azure.PublicCloud,
+			wantErr: "does not match vault host",
+		},
+		{
+			name:      "explicit URL with the resource of the environment",
+			authority: "https://login.windows.net/", resource: "https://vault.azure.net",
+			vaultURL: "https://127.0.0.1:8443/", env: azure.PublicCloud, explicitURL: true,
+		},
+		{
+			name:      "explicit URL with another resource",
+			authority: "https://login.windows.net/", resource: "https://attacker.com",
+			vaultURL: "https://vault.attacker.com/", env: azure.PublicCloud, explicitURL: true,
+			wantErr: "does not match resource",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge := &BearerChallenge{ActiveDirectoryEndpoint: test.authority, TenantID: "tenant", Resource: test.resource}
+			err := challenge.verify(test.vaultURL, &test.env, test.explicitURL)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("verify: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBearerChallengeApplyTo(t *testing.T) {
+	challenge := &BearerChallenge{ActiveDirectoryEndpoint: "https://login.microsoftonline.us/", TenantID: "tenant", Resource: "https://vault.usgovcloudapi.net"}
+
+	env := challenge.applyTo(&azure.PublicCloud, false)
+	if env.ActiveDirectoryEndpoint != challenge.ActiveDirectoryEndpoint || env.ResourceIdentifiers.KeyVault != challenge.Resource {
+		t.Errorf("applyTo = %s %s, want the authority and resource of the challenge", env.ActiveDirectoryEndpoint, env.ResourceIdentifiers.KeyVault)
+	}
+	env = challenge.applyTo(&azure.PublicCloud, true)
+	if env.ResourceIdentifiers.KeyVault != azure.PublicCloud.ResourceIdentifiers.KeyVault {
+		t.Errorf("the resource of an explicit URL is taken from the challenge: %s", env.ResourceIdentifiers.KeyVault)
+	}
+	if azure.PublicCloud.ActiveDirectoryEndpoint == challenge.ActiveDirectoryEndpoint {
+		t.Errorf("applyTo changed the environment it was given")
+	}
+}
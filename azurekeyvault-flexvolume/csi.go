@@ -0,0 +1,311 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	csiDriverName = "keyvault.csi.azure.com"
+	csiPodName    = "csi.storage.k8s.io/pod.name"
+	csiPodNS      = "csi.storage.k8s.io/pod.namespace"
+	// service account tokens of the pod, when the CSIDriver object requests them
+	csiServiceAccountTokens = "csi.storage.k8s.io/serviceAccount.tokens"
+	// audience of the token of the vault kubernetes login
+	csiVaultTokenAudience = "vault"
+	// audience of the token exchanged by the workload credential
+	csiWorkloadTokenAudience = "api://AzureADTokenExchange"
+	// keys of the nodePublishSecretRef secret, same as the flexVolume secretRef
+	csiSecretClientID     = "clientid"
+	csiSecretClientSecret = "clientsecret"
+)
+
+// CSIDriver serves the CSI Identity and Node services. NodePublishVolume takes the flexVolume
+// options as volume attributes and populates a tmpfs at the target path.
+type CSIDriver struct {
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedNodeServer
+
+	name   string
+	nodeID string
+	// settings of the node, also used by the agents of the volumes
+	node NodeOptions
+	// serialises the calls for the same target path
+	locks sync.Map
+}
+
+// runCSIDriver is the csi subcommand, it serves the CSI services until it is terminated
+func runCSIDriver(args []string) int {
+	var endpoint string
+	driver := &CSIDriver{}
+	flag.StringVar(&endpoint, "endpoint", "unix:///csi/csi.sock", "CSI endpoint.")
+	flag.StringVar(&driver.name, "driverName", csiDriverName, "Name of the CSI driver.")
+	flag.StringVar(&driver.nodeID, "nodeId", "", "Name of the node.")
+	registerNodeFlags(flag.CommandLine, &driver.node)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+	defer glog.Flush()
+
+	if driver.nodeID == "" {
+		glog.Errorf("[error] : -nodeId is not set")
+		return 1
+	}
+	if err := configureHTTPClient(driver.node.Transport); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	listener, err := listenUnix(endpoint)
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	csi.RegisterIdentityServer(server, driver)
+	csi.RegisterNodeServer(server, driver)
+	stopOnSignal(server)
+
+	glog.Infof("starting the %s %s csi driver %s on %s", program, version, driver.name, endpoint)
+	if err := server.Serve(listener); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	return 0
+}
+
+// GetPluginInfo returns the name and version of the driver
+func (driver *CSIDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: driver.name, VendorVersion: version}, nil
+}
+
+// GetPluginCapabilities returns no capabilities, the driver has no controller service
+func (driver *CSIDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+// Probe returns ready as long as the driver is serving
+func (driver *CSIDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+// NodeGetCapabilities returns no capabilities, volumes are not staged
+func (driver *CSIDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+// NodeGetInfo returns the node the driver runs on
+func (driver *CSIDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: driver.nodeID}, nil
+}
+
+// NodePublishVolume mounts a tmpfs at the target path and writes the key vault objects into it
+func (driver *CSIDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is not set")
+	}
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is not set")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is not set")
+	}
+	unlock := driver.lock(targetPath)
+	defer unlock()
+
+	params := csiVolumeParams(req.GetVolumeContext(), req.GetSecrets())
+	options, err := optionsFromParams(params, driver.node)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	options.dir = targetPath
+	applyPodTokens(options, req.GetVolumeContext()[csiServiceAccountTokens])
+	if err := Validate(*options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mounted, err := isMounted(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		glog.V(2).Infof("%s is already mounted", targetPath)
+		// a republish brings fresh tokens, the agent reads them when it authenticates again
+		if tokens := req.GetVolumeContext()[csiServiceAccountTokens]; tokens != "" && (options.agent || options.sshAgent) {
+			if err := writeAgentTokens(driver.node.StateDir, targetPath, tokens); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := os.MkdirAll(targetPath, driverMountDirPermission); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mkdir at %s: %s", targetPath, err)
+	}
+	if err := mountTmpfs(targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount at %s: %s", targetPath, err)
+	}
+
+	if options.agent || options.sshAgent {
+		// replaces the tokens left by a previous agent of the path
+		removeAgentTokens(driver.node.StateDir, targetPath)
+		err = startAgent(targetPath, params, req.GetVolumeContext()[csiServiceAccountTokens], driver.node)
+	} else {
+		adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
+		err = adapter.Run()
+	}
+	if err != nil {
+		if err := unmountTmpfs(targetPath); err != nil {
+			glog.Errorf("failed to unmount %s: %s", targetPath, err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume wipes the files of the volume, unmounts the tmpfs at the target path and removes it
+func (driver *CSIDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is not set")
+	}
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is not set")
+	}
+	unlock := driver.lock(targetPath)
+	defer unlock()
+
+	mounted, err := isMounted(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		stopAgent(targetPath)
+		removeAgentTokens(driver.node.StateDir, targetPath)
+		wipeBeforeUnmount(driver.node.StateDir, targetPath)
+		if err := unmountTmpfs(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount volume at %s: %s", targetPath, err)
+		}
+	}
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to remove %s: %s", targetPath, err)
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// lock serialises the calls for path and returns the function releasing it
+func (driver *CSIDriver) lock(path string) func() {
+	mutex, _ := driver.locks.LoadOrStore(path, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	return mutex.(*sync.Mutex).Unlock
+}
+
+// csiVolumeParams maps the volume attributes and secrets of a CSI volume to the flexVolume options.
+// Only the attributes of the allowlist of flexVolumeFlags are kept, the pod and its secrets are set last.
+func csiVolumeParams(volumeContext, secrets map[string]string) map[string]string {
+	params := map[string]string{}
+	for key, value := range volumeContext {
+		if _, ok := flexVolumeFlags[key]; ok {
+			params[key] = value
+		}
+	}
+	params["kubernetes.io/pod.name"] = volumeContext[csiPodName]
+	params["kubernetes.io/pod.namespace"] = volumeContext[csiPodNS]
+	params[flexVolumeSecretClientID] = secrets[csiSecretClientID]
+	params[flexVolumeSecretClientSecret] = secrets[csiSecretClientSecret]
+	return params
+}
+
+// applyPodTokens sets the service account tokens of the pod on options. They come from the
+// volume attributes set by the kubelet, the tokens of the node are never used for a volume.
+func applyPodTokens(options *Option, tokens string) {
+	options.federatedToken = csiPodTokens(tokens)[csiWorkloadTokenAudience]
+	options.vaultServiceAccountToken = csiServiceAccountToken(tokens)
+}
+
+// csiServiceAccountToken returns the pod token for the vault audience, or for the audience of the
+// API server. The tokens of other audiences, e.g. the AAD token exchange, are never sent to Vault.
+func csiServiceAccountToken(tokens string) string {
+	audiences := csiPodTokens(tokens)
+	if token, ok := audiences[csiVaultTokenAudience]; ok {
+		return token
+	}
+	return audiences[""]
+}
+
+// csiPodTokens returns the service account tokens of the pod by audience
+func csiPodTokens(tokens string) map[string]string {
+	if tokens == "" {
+		return nil
+	}
+	var audiences map[string]struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(tokens), &audiences); err != nil {
+		glog.Warningf("failed to parse the service account tokens of the pod: %s", err)
+		return nil
+	}
+	byAudience := map[string]string{}
+	for audience, token := range audiences {
+		byAudience[audience] = token.Token
+	}
+	return byAudience
+}
+
+// listenUnix listens on a unix:// endpoint, removing the socket left by a previous run
+func listenUnix(endpoint string) (net.Listener, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "unix" {
+		return nil, fmt.Errorf("invalid endpoint %q, should be unix:///path/to/socket", endpoint)
+	}
+	socket := u.Path
+	if socket == "" {
+		socket = u.Host
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to remove %s", socket)
+	}
+	return net.Listen("unix", socket)
+}
+
+// stopOnSignal stops the server gracefully when the process is terminated
+func stopOnSignal(server *grpc.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		glog.Infof("received %s, stopping", sig)
+		server.GracefulStop()
+	}()
+}
+
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	glog.V(2).Infof("grpc call: %s", info.FullMethod)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("grpc call %s failed: %s", info.FullMethod, err)
+	}
+	return resp, err
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCSIVolumeParams(t *testing.T) {
+	secrets := map[string]string{csiSecretClientID: "podclient", csiSecretClientSecret: "podsecret"}
+	tests := []struct {
+		name      string
+		attribute string
+		value     string
+		// the param expected for the attribute, empty when it is dropped
+		want string
+	}{
+		{name: "volume option", attribute: "keyvaultname", value: "testvault", want: "testvault"},
+		{name: "object names", attribute: "keyvaultobjectnames", value: "a;b", want: "a;b"},
+		{name: "ca bundle", attribute: "cabundle", value: "/etc/shadow"},
+		{name: "cloud env file", attribute: "cloudenvfile", value: "/etc/shadow"},
+		{name: "msi endpoint", attribute: "msiendpoint", value: "http://127.0.0.1:1/"},
+		{name: "https proxy", attribute: "httpsproxy", value: "http://attacker:3128"},
+		{name: "no proxy", attribute: "noproxy", value: "*"},
+		{name: "http timeout", attribute: "httptimeout", value: "1h"},
+		{name: "federated token file", attribute: "federatedtokenfile", value: "/var/run/secrets/tokens/azure-identity-token"},
+		{name: "vault token file", attribute: "vaultserviceaccounttokenfile", value: "/var/run/secrets/kubernetes.io/serviceaccount/token"},
+		{name: "vault token", attribute: "vaultserviceaccounttoken", value: "injected"},
+		{name: "unknown attribute", attribute: "unknown", value: "value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := csiVolumeParams(map[string]string{test.attribute: test.value}, secrets)
+			if got := params[test.attribute]; got != test.want {
+				t.Errorf("param %s = %q, want %q", test.attribute, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCSIVolumeParamsPodAndSecrets(t *testing.T) {
+	volumeContext := map[string]string{
+		csiPodName:                   "nginx",
+		csiPodNS:                     "default",
+		"kubernetes.io/pod.name":     "other",
+		flexVolumeSecretClientID:     "injected",
+		flexVolumeSecretClientSecret: "injected",
+	}
+	secrets := map[string]string{csiSecretClientID: "podclient", csiSecretClientSecret: "podsecret"}
+
+	params := csiVolumeParams(volumeContext, secrets)
+	want := map[string]string{
+		"kubernetes.io/pod.name":      "nginx",
+		"kubernetes.io/pod.namespace": "default",
+		flexVolumeSecretClientID:      "podclient",
+		flexVolumeSecretClientSecret:  "podsecret",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("param %s = %q, want %q", key, params[key], value)
+		}
+	}
+}
+
+func TestOptionsFromParamsNodeSettings(t *testing.T) {
+	node := NodeOptions{CloudEnvFile: "/etc/kubernetes/azurestackcloud.json", MSIEndpoint: "http://127.0.0.1:2579/token"}
+	node.Transport.CABundle = "/etc/ssl/proxy-ca.pem"
+	node.Transport.Timeout = 30 * time.Second
+
+	params := map[string]string{
+		"keyvaultname":                 "testvault",
+		"keyvaultobjectnames":          "secret1",
+		"keyvaultobjecttypes":          "secret",
+		"cloudenvfile":                 "/etc/shadow",
+		"msiendpoint":                  "http://attacker/",
+		"cabundle":                     "/etc/shadow",
+		"httptimeout":                  "1h",
+		"federatedtokenfile":           "/etc/shadow",
+		"vaultserviceaccounttokenfile": "/etc/shadow",
+	}
+	options, err := optionsFromParams(params, node)
+	if err != nil {
+		t.Fatalf("optionsFromParams: %s", err)
+	}
+	if options.vaultName != "testvault" || options.vaultObjectNames != "secret1" {
+		t.Errorf("volume options not set: %+v", options)
+	}
+	if options.cloudEnvFile != node.CloudEnvFile {
+		t.Errorf("cloudEnvFile = %q, want %q", options.cloudEnvFile, node.CloudEnvFile)
+	}
+	if options.msiEndpoint != node.MSIEndpoint {
+		t.Errorf("msiEndpoint = %q, want %q", options.msiEndpoint, node.MSIEndpoint)
+	}
+	if options.transport != node.Transport {
+		t.Errorf("transport = %+v, want %+v", options.transport, node.Transport)
+	}
+	if options.federatedTokenFile != "" || options.vaultServiceAccountTokenFile != "" || options.vaultToken != "" {
+		t.Errorf("tokens of the driver are used: %q, %q, %q", options.federatedTokenFile, options.vaultServiceAccountTokenFile, options.vaultToken)
+	}
+}
+
+func TestApplyPodTokens(t *testing.T) {
+	tokens := `{"api://AzureADTokenExchange": {"token": "workload-token", "expirationTimestamp": "2030-01-01T00:00:00Z"}, "vault": {"token": "vault-token"}}`
+	var options Option
+	applyPodTokens(&options, tokens)
+	if options.federatedToken != "workload-token" {
+		t.Errorf("federatedToken = %q, want %q", options.federatedToken, "workload-token")
+	}
+	if options.vaultServiceAccountToken != "vault-token" {
+		t.Errorf("vaultServiceAccountToken = %q, want %q", options.vaultServiceAccountToken, "vault-token")
+	}
+
+	// the token exchanged with AAD is never sent to Vault
+	options = Option{}
+	applyPodTokens(&options, `{"api://AzureADTokenExchange": {"token": "workload-token"}, "other": {"token": "other-token"}}`)
+	if options.vaultServiceAccountToken != "" {
+		t.Errorf("vaultServiceAccountToken = %q, want none without the vault audience", options.vaultServiceAccountToken)
+	}
+
+	options = Option{}
+	applyPodTokens(&options, `{"api://AzureADTokenExchange": {"token": "workload-token"}, "": {"token": "api-server-token"}}`)
+	if options.vaultServiceAccountToken != "api-server-token" {
+		t.Errorf("vaultServiceAccountToken = %q, want the token of the API server audience", options.vaultServiceAccountToken)
+	}
+
+	options = Option{}
+	applyPodTokens(&options, `{"vault": {"token": "vault-token"}}`)
+	if options.federatedToken != "" {
+		t.Errorf("federatedToken = %q, want none without the token exchange audience", options.federatedToken)
+	}
+}
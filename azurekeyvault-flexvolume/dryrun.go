@@ -0,0 +1,185 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+// Status of an object checked by a dry run
+const (
+	DryRunOK          = "OK"
+	DryRunNotFound    = "NotFound"
+	DryRunForbidden   = "Forbidden"
+	DryRunDisabled    = "Disabled"
+	DryRunExpired     = "Expired"
+	DryRunNotYetValid = "NotYetValid"
+	DryRunExpiring    = "Expiring"
+	DryRunUnverified  = "Unverified"
+	DryRunSkipped     = "Skipped"
+	DryRunError       = "Error"
+)
+
+// Exit codes of a dry run
+const (
+	// every object can be read
+	dryRunExitOK = 0
+	// the options are invalid or no token could be retrieved
+	dryRunExitFailure = 1
+	// at least one object cannot be read
+	dryRunExitObjects = 2
+)
+
+// DryRunResult is the outcome of reading an object
+type DryRunResult struct {
+	Type    string
+	Name    string
+	Version string
+	Status  string
+	Message string
+}
+
+// DryRun authenticates and reads every object without writing anything. The error is only
+// set when the provider cannot be used at all, the failures of the objects are in the results.
+func (adapter *KeyvaultFlexvolumeAdapter) DryRun() ([]DryRunResult, error) {
+	options := adapter.options
+	ctx := adapter.ctx
+
+	backend, err := newBackend(ctx, options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize the %s provider", options.provider)
+	}
+
+	objectTypes := strings.Split(options.vaultObjectTypes, objectsSep)
+	objectNames := strings.Split(options.vaultObjectNames, objectsSep)
+	objectVersions := strings.Split(options.vaultObjectVersions, objectsSep)
+	objectVerifyWith := strings.Split(options.vaultObjectVerifyWith, objectsSep)
+	objectFormats := strings.Split(options.vaultObjectFormats, objectsSep)
+	objectLayouts := strings.Split(options.vaultObjectLayouts, objectsSep)
+
+	var results []DryRunResult
+	for i := range objectNames {
+		result := DryRunResult{Type: objectTypes[i], Name: objectNames[i], Status: DryRunOK}
+		if options.vaultObjectVersions != "" && len(objectVersions) == len(objectNames) {
+			result.Version = objectVersions[i]
+		}
+
+		bundle, err := resolveObject(ctx, backend, result.Type, result.Name, result.Version)
+		var notBefore, notAfter *time.Time
+		if err == nil {
+			notBefore, notAfter = objectValidity(bundle)
+		}
+		switch {
+		case errors.Cause(err) == errVaultCertificateNotIssued:
+			// issuing a certificate is not a read, the mounts issue their own
+			result.Status = DryRunSkipped
+			result.Message = "issued on every mount, not checked"
+		case err != nil:
+			result.Status = dryRunErrorStatus(err)
+			result.Message = strings.Replace(err.Error(), "\n", " ", -1)
+		case bundle.Enabled != nil && !*bundle.Enabled:
+			result.Status = DryRunDisabled
+		case notAfter != nil && notAfter.Before(time.Now()):
+			result.Status = DryRunExpired
+			result.Message = fmt.Sprintf("expired on %s", notAfter.Format(time.RFC3339))
+		case notBefore != nil && notBefore.After(time.Now()):
+			result.Status = DryRunNotYetValid
+			result.Message = fmt.Sprintf("not valid before %s", notBefore.Format(time.RFC3339))
+		case notAfter != nil && notAfter.Sub(time.Now()) < options.expiryWarningThreshold:
+			result.Status = DryRunExpiring
+			result.Message = fmt.Sprintf("expires on %s", notAfter.Format(time.RFC3339))
+		}
+		if result.Status == DryRunOK && len(objectVerifyWith) == len(objectNames) && objectVerifyWith[i] != "" {
+			content, err := formatObject(bundle)
+			if err == nil {
+				err = verifyObject(ctx, backend, result.Type, result.Name, objectVerifyWith[i], content)
+			}
+			if err != nil {
+				result.Status = DryRunUnverified
+				result.Message = strings.Replace(err.Error(), "\n", " ", -1)
+			}
+		}
+		// keystores and layouts need the private key of the backing secret of the certificate
+		needsKey := (len(objectFormats) == len(objectNames) && objectFormats[i] != "") ||
+			(len(objectLayouts) == len(objectNames) && objectLayouts[i] != "")
+		if result.Status == DryRunOK && needsKey {
+			secret, err := backend.GetSecret(ctx, bundle.Name, bundle.Version)
+			if err == nil {
+				_, _, err = certificateKeyPair(secret)
+			}
+			if err != nil {
+				result.Status = dryRunErrorStatus(err)
+				result.Message = strings.Replace(err.Error(), "\n", " ", -1)
+			}
+		}
+		if err == nil && result.Version == "" {
+			result.Version = bundle.Version
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// dryRunErrorStatus maps the status code of a Key Vault or backend error to a status
+func dryRunErrorStatus(err error) string {
+	switch errorStatusCode(err) {
+	case http.StatusNotFound:
+		return DryRunNotFound
+	case http.StatusForbidden:
+		// Key Vault forbids reading disabled objects
+		if isDisabledError(err) {
+			return DryRunDisabled
+		}
+		return DryRunForbidden
+	default:
+		return DryRunError
+	}
+}
+
+// errorStatusCode returns the HTTP status code of a Key Vault or backend error, 0 for other errors
+func errorStatusCode(err error) int {
+	statusCode := 0
+	switch cause := errors.Cause(err).(type) {
+	case azure.RequestError:
+		statusCode, _ = cause.StatusCode.(int)
+	case *azure.RequestError:
+		statusCode, _ = cause.StatusCode.(int)
+	case autorest.DetailedError:
+		statusCode, _ = cause.StatusCode.(int)
+	case *autorest.DetailedError:
+		statusCode, _ = cause.StatusCode.(int)
+	case *BackendError:
+		statusCode = cause.StatusCode
+	}
+	return statusCode
+}
+
+// printDryRun prints the results as a table and returns the exit code
+func printDryRun(w io.Writer, results []DryRunResult) int {
+	exitCode := dryRunExitOK
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TYPE\tNAME\tVERSION\tSTATUS\tMESSAGE")
+	for _, result := range results {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", result.Type, result.Name, result.Version, result.Status, result.Message)
+		// expiring objects can still be read and skipped objects cannot be checked, they are only reported
+		if result.Status != DryRunOK && result.Status != DryRunExpiring && result.Status != DryRunSkipped {
+			exitCode = dryRunExitObjects
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return dryRunExitFailure
+	}
+	return exitCode
+}
@@ -0,0 +1,636 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	emulatorTokenLifetime = time.Hour
+	emulatorPermission    = 0644
+)
+
+// collections of the Key Vault data plane, by object type
+var emulatorCollections = map[string]string{
+	"secrets":      VaultTypeSecret,
+	"keys":         VaultTypeKey,
+	"certificates": VaultTypeCertificate,
+}
+
+// Emulator serves the Key Vault data plane for the objects of a fixture, with a fake AAD token
+// endpoint on the same https address, and fake IMDS and NMI endpoints on an http address.
+type Emulator struct {
+	store    *FileBackend
+	vaultURL string
+	tenantID string
+	resource string
+	// the service principal accepted by AAD, any client when clientID is empty
+	clientID     string
+	clientSecret string
+	// the issuer and subject of the federated credential of clientID, any when empty
+	federatedIssuer  string
+	federatedSubject string
+	// objects answered with 403, as type/name
+	forbidden map[string]bool
+	// every throttleEvery-th data plane request is answered with 429
+	throttleEvery int
+	pageSize      int
+	tokenLifetime time.Duration
+
+	mutex sync.Mutex
+	// expiry of the issued access tokens
+	tokens   map[string]time.Time
+	requests int
+}
+
+// runEmulator is the emulator subcommand, it serves the emulator until it is terminated
+func runEmulator(args []string) int {
+	var fixture, addr, identityAddr, caFile, cloudEnvFile, forbidden string
+	emulator := &Emulator{tokens: map[string]time.Time{}, forbidden: map[string]bool{}}
+	flag.StringVar(&fixture, "fixture", "", "Directory tree or JSON/YAML fixture file of the objects, as for the file provider.")
+	flag.StringVar(&addr, "addr", "127.0.0.1:8443", "https address of the vault and AAD endpoints.")
+	flag.StringVar(&identityAddr, "identityAddr", "127.0.0.1:2579", "http address of the IMDS and NMI endpoints.")
+	flag.StringVar(&caFile, "caFile", "", "Path to write the self-signed certificate of the emulator to, for -caBundle.")
+	flag.StringVar(&cloudEnvFile, "cloudEnvFile", "", "Path to write the cloud environment of the emulator to, for -cloudEnvFile.")
+	flag.StringVar(&emulator.tenantID, "tenantId", "00000000-0000-0000-0000-000000000000", "Tenant of the vault.")
+	flag.StringVar(&emulator.resource, "resource", "https://vault.azure.net", "Resource of the tokens accepted by the vault.")
+	flag.StringVar(&emulator.clientID, "clientId", "", "Client id accepted by AAD. Empty to accept any client.")
+	flag.StringVar(&emulator.clientSecret, "clientSecret", "", "Client secret accepted by AAD for -clientId.")
+	flag.StringVar(&emulator.federatedIssuer, "federatedIssuer", "", "Issuer of the client assertions accepted by AAD. Empty to accept any issuer.")
+	flag.StringVar(&emulator.federatedSubject, "federatedSubject", "", "Subject of the client assertions accepted by AAD, e.g. system:serviceaccount:default:nginx. Empty to accept any subject.")
+	flag.DurationVar(&emulator.tokenLifetime, "tokenLifetime", emulatorTokenLifetime, "Lifetime of the access tokens.")
+	flag.StringVar(&forbidden, "forbidden", "", "Objects answered with 403, semi-colon separated type/name, e.g. secret/private.")
+	flag.IntVar(&emulator.throttleEvery, "throttleEvery", 0, "Answer every n-th vault request with 429. 0 to never throttle.")
+	flag.IntVar(&emulator.pageSize, "pageSize", 25, "Maximum number of items of a list page.")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+	defer glog.Flush()
+
+	if fixture == "" {
+		glog.Errorf("[error] : -fixture is not set")
+		return 1
+	}
+	store, err := newFileBackend(context.Background(), Option{filePath: fixture})
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	emulator.store = store.(*FileBackend)
+	emulator.vaultURL = fmt.Sprintf("https://%s/", addr)
+	emulator.resource = strings.TrimSuffix(emulator.resource, "/")
+	for _, object := range strings.Split(forbidden, objectsSep) {
+		if object != "" {
+			emulator.forbidden[object] = true
+		}
+	}
+
+	certificate, err := emulatorCertificate(addr)
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	if caFile != "" {
+		pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]})
+		if err := ioutil.WriteFile(caFile, pemCert, emulatorPermission); err != nil {
+			glog.Errorf("[error] : failed to write %s: %s", caFile, err)
+			return 1
+		}
+	}
+	if cloudEnvFile != "" {
+		if err := emulator.writeEnvironment(cloudEnvFile); err != nil {
+			glog.Errorf("[error] : %s", err)
+			return 1
+		}
+	}
+
+	vaultMux := http.NewServeMux()
+	vaultMux.HandleFunc("/", emulator.serveVault)
+	vaultServer := &http.Server{Addr: addr, Handler: vaultMux, TLSConfig: &tls.Config{Certificates: []tls.Certificate{*certificate}}}
+	identityMux := http.NewServeMux()
+	identityMux.HandleFunc("/metadata/identity/oauth2/token", emulator.serveIMDS)
+	identityMux.HandleFunc("/"+nmipath, emulator.serveNMI)
+	identityServer := &http.Server{Addr: identityAddr, Handler: identityMux}
+
+	errs := make(chan error, 2)
+	go func() { errs <- vaultServer.ListenAndServeTLS("", "") }()
+	go func() { errs <- identityServer.ListenAndServe() }()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	glog.Infof("starting the %s %s key vault emulator: vault and AAD on %s, IMDS and NMI on http://%s", program, version, emulator.vaultURL, identityAddr)
+	select {
+	case err := <-errs:
+		glog.Errorf("[error] : %s", err)
+		return 1
+	case sig := <-signals:
+		glog.Infof("received %s, stopping", sig)
+		return 0
+	}
+}
+
+// emulatorCertificate returns a self-signed certificate for localhost and the host of addr
+func emulatorCertificate(addr string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: program + " emulator"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the emulator certificate")
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// writeEnvironment writes a cloud environment pointing AAD at the emulator
+func (emulator *Emulator) writeEnvironment(path string) error {
+	env := azure.PublicCloud
+	env.Name = "AzureKeyVaultEmulator"
+	env.ActiveDirectoryEndpoint = emulator.vaultURL
+	env.KeyVaultEndpoint = emulator.resource + "/"
+	env.ResourceIdentifiers.KeyVault = emulator.resource
+	content, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(ioutil.WriteFile(path, content, emulatorPermission), "failed to write %s", path)
+}
+
+// issueToken returns a new access token for client, and forgets the expired ones
+func (emulator *Emulator) issueToken(client, resource string) adal.Token {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	accessToken := "emulator." + hex.EncodeToString(random)
+	now := time.Now()
+	expires := now.Add(emulator.tokenLifetime)
+	emulator.mutex.Lock()
+	for token, tokenExpires := range emulator.tokens {
+		if !now.Before(tokenExpires) {
+			delete(emulator.tokens, token)
+		}
+	}
+	emulator.tokens[accessToken] = expires
+	emulator.mutex.Unlock()
+
+	return adal.Token{
+		AccessToken: accessToken,
+		ExpiresIn:   json.Number(strconv.Itoa(int(emulator.tokenLifetime.Seconds()))),
+		ExpiresOn:   json.Number(strconv.FormatInt(expires.Unix(), 10)),
+		NotBefore:   json.Number(strconv.FormatInt(now.Unix(), 10)),
+		Resource:    resource,
+		Type:        "Bearer",
+	}
+}
+
+// checkResource answers 400 when tokens are requested for another resource than the vault's
+func (emulator *Emulator) checkResource(w http.ResponseWriter, resource string) bool {
+	if strings.TrimSuffix(resource, "/") != emulator.resource {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_resource", "error_description": fmt.Sprintf("unknown resource %q", resource)})
+		return false
+	}
+	return true
+}
+
+// serveAAD answers the client credentials grant, with a client secret or a client assertion
+func (emulator *Emulator) serveAAD(w http.ResponseWriter, r *http.Request, tenantID string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if tenantID != emulator.tenantID && tenantID != adfsIdentitySystem {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_tenant", "error_description": fmt.Sprintf("unknown tenant %q", tenantID)})
+		return
+	}
+	if !emulator.checkResource(w, r.PostForm.Get("resource")) {
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	var err error
+	if assertion := r.PostForm.Get("client_assertion"); assertion != "" {
+		err = emulator.checkAssertion(r.PostForm.Get("client_assertion_type"), assertion)
+	} else if r.PostForm.Get("client_secret") == "" || (emulator.clientID != "" && r.PostForm.Get("client_secret") != emulator.clientSecret) {
+		err = fmt.Errorf("invalid client secret")
+	}
+	if err == nil && emulator.clientID != "" && clientID != emulator.clientID {
+		err = fmt.Errorf("unknown client %q", clientID)
+	}
+	if err == nil && r.PostForm.Get("grant_type") != "client_credentials" {
+		err = fmt.Errorf("unsupported grant type %q", r.PostForm.Get("grant_type"))
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client", "error_description": err.Error()})
+		return
+	}
+	glog.V(2).Infof("emulator: AAD issued a token to %s", clientID)
+	writeJSON(w, http.StatusOK, emulator.issueToken(clientID, r.PostForm.Get("resource")))
+}
+
+// checkAssertion checks a client assertion is a service account token for the audience of the token
+// exchange, not expired, and from the issuer and subject of the federated credential when they are set.
+// The keys of the issuer are not known to the emulator, the signature is not verified.
+func (emulator *Emulator) checkAssertion(assertionType, assertion string) error {
+	if assertionType != clientAssertionType {
+		return fmt.Errorf("unsupported client assertion type %q", assertionType)
+	}
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("the client assertion is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("invalid client assertion payload: %s", err)
+	}
+	var claims struct {
+		Issuer   string          `json:"iss"`
+		Subject  string          `json:"sub"`
+		Audience json.RawMessage `json:"aud"`
+		Expiry   int64           `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("invalid client assertion claims: %s", err)
+	}
+
+	// aud is a string or an array of strings
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		var audience string
+		_ = json.Unmarshal(claims.Audience, &audience)
+		audiences = []string{audience}
+	}
+	audienceOK := false
+	for _, audience := range audiences {
+		audienceOK = audienceOK || audience == csiWorkloadTokenAudience
+	}
+	switch {
+	case !audienceOK:
+		return fmt.Errorf("the client assertion is not for audience %s", csiWorkloadTokenAudience)
+	case claims.Expiry == 0 || time.Now().Unix() >= claims.Expiry:
+		return fmt.Errorf("the client assertion is expired")
+	case emulator.federatedIssuer != "" && claims.Issuer != emulator.federatedIssuer:
+		return fmt.Errorf("unknown client assertion issuer %q", claims.Issuer)
+	case emulator.federatedSubject != "" && claims.Subject != emulator.federatedSubject:
+		return fmt.Errorf("unknown client assertion subject %q", claims.Subject)
+	}
+	return nil
+}
+
+// serveIMDS answers the managed identity token requests
+func (emulator *Emulator) serveIMDS(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata") != "true" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request", "error_description": "Required metadata header not specified"})
+		return
+	}
+	query := r.URL.Query()
+	if !emulator.checkResource(w, query.Get("resource")) {
+		return
+	}
+	clientID := "system-assigned"
+	for _, selector := range []string{"client_id", imdsResourceIDParam, imdsObjectIDParam} {
+		if query.Get(selector) != "" {
+			clientID = query.Get(selector)
+		}
+	}
+	glog.V(2).Infof("emulator: IMDS issued a token to %s", clientID)
+	writeJSON(w, http.StatusOK, IMDSResponse{Token: emulator.issueToken(clientID, query.Get("resource")), ClientID: clientID})
+}
+
+// serveNMI answers the pod identity token requests
+func (emulator *Emulator) serveNMI(w http.ResponseWriter, r *http.Request) {
+	podns, podname := r.Header.Get(podnsheader), r.Header.Get(podnameheader)
+	if podns == "" || podname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resource := r.URL.Query().Get("resource")
+	if !emulator.checkResource(w, resource) {
+		return
+	}
+	clientID := fmt.Sprintf("pod-%s-%s", podns, podname)
+	glog.V(2).Infof("emulator: NMI issued a token to %s/%s", podns, podname)
+	writeJSON(w, http.StatusOK, NMIResponse{Token: emulator.issueToken(clientID, resource), ClientID: clientID})
+}
+
+// serveVault routes the AAD token requests and the data plane requests
+func (emulator *Emulator) serveVault(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) == 3 && segments[1] == "oauth2" && segments[2] == "token" {
+		emulator.serveAAD(w, r, segments[0])
+		return
+	}
+
+	if !emulator.authorized(r) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer authorization="%s%s", resource="%s"`, emulator.vaultURL, emulator.tenantID, emulator.resource))
+		writeVaultError(w, http.StatusUnauthorized, "Unauthorized", "AKV10000: Request is missing a Bearer or PoP token.")
+		return
+	}
+	if emulator.throttled() {
+		w.Header().Set("Retry-After", "1")
+		writeVaultError(w, http.StatusTooManyRequests, "Throttled", "Request was not processed because too many requests were received.")
+		return
+	}
+
+	objectType, ok := emulatorCollections[segments[0]]
+	if ok && objectType == VaultTypeKey && r.Method == http.MethodPost && (len(segments) == 3 || len(segments) == 4) {
+		version := ""
+		if len(segments) == 4 {
+			version = segments[2]
+		}
+		emulator.serveKeyOperation(w, r, segments[1], version, segments[len(segments)-1])
+		return
+	}
+	if !ok || r.Method != http.MethodGet || len(segments) > 3 {
+		writeVaultError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("unknown path %s", r.URL.Path))
+		return
+	}
+	switch {
+	case len(segments) == 1:
+		items, _ := emulator.store.List(r.Context(), objectType)
+		emulator.writeList(w, r, items)
+	case len(segments) == 3 && segments[2] == "versions":
+		items, err := emulator.store.Versions(r.Context(), objectType, segments[1])
+		if err != nil {
+			writeVaultError(w, http.StatusNotFound, notFoundCode(objectType), err.Error())
+			return
+		}
+		emulator.writeList(w, r, items)
+	default:
+		version := ""
+		if len(segments) == 3 {
+			version = segments[2]
+		}
+		emulator.writeObject(w, r, objectType, segments[1], version)
+	}
+}
+
+// authorized checks the bearer token of a request was issued by the emulator
+func (emulator *Emulator) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+	expires, ok := emulator.tokens[token]
+	return ok && time.Now().Before(expires)
+}
+
+// throttled counts the data plane requests and returns true for every throttleEvery-th
+func (emulator *Emulator) throttled() bool {
+	emulator.mutex.Lock()
+	defer emulator.mutex.Unlock()
+	emulator.requests++
+	return emulator.throttleEvery > 0 && emulator.requests%emulator.throttleEvery == 0
+}
+
+// writeObject writes the bundle of an object version
+func (emulator *Emulator) writeObject(w http.ResponseWriter, r *http.Request, objectType, name, version string) {
+	if emulator.forbidden[objectType+"/"+name] {
+		writeVaultError(w, http.StatusForbidden, "Forbidden", fmt.Sprintf("The user, group or application does not have %s get permission on key vault", objectType))
+		return
+	}
+	bundle, err := getObject(r.Context(), emulator.store, objectType, name, version)
+	if err != nil {
+		writeVaultError(w, http.StatusNotFound, notFoundCode(objectType), err.Error())
+		return
+	}
+	if bundle.Enabled != nil && !*bundle.Enabled {
+		writeVaultError(w, http.StatusForbidden, "Forbidden", fmt.Sprintf("Operation get is not allowed on a disabled %s.", objectType))
+		return
+	}
+
+	body := emulator.itemJSON(bundle.ObjectItem)
+	id := emulator.objectID(bundle.ObjectItem)
+	switch objectType {
+	case VaultTypeSecret:
+		body["value"] = string(bundle.Value)
+		if bundle.ContentType != "" {
+			body["contentType"] = bundle.ContentType
+		}
+	case VaultTypeKey:
+		delete(body, "kid")
+		body["key"] = map[string]string{
+			"kid": id,
+			"kty": bundle.Key.Kty,
+			"n":   bundle.Key.N,
+			"e":   bundle.Key.E,
+			"crv": bundle.Key.Crv,
+			"x":   bundle.Key.X,
+			"y":   bundle.Key.Y,
+		}
+	case VaultTypeCertificate:
+		body["cer"] = bundle.Value
+		body["kid"] = strings.Replace(id, "/certificates/", "/keys/", 1)
+		body["sid"] = strings.Replace(id, "/certificates/", "/secrets/", 1)
+		thumbprint := sha1.Sum(bundle.Value)
+		body["x5t"] = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// serveKeyOperation signs, verifies, wraps, unwraps, encrypts or decrypts with the private key of a fixture key
+func (emulator *Emulator) serveKeyOperation(w http.ResponseWriter, r *http.Request, name, version, operation string) {
+	if emulator.forbidden[VaultTypeKey+"/"+name] {
+		writeVaultError(w, http.StatusForbidden, "Forbidden", fmt.Sprintf("The user, group or application does not have keys %s permission on key vault", operation))
+		return
+	}
+	object, err := emulator.store.get(VaultTypeKey, name, version)
+	if err != nil {
+		writeVaultError(w, http.StatusNotFound, notFoundCode(VaultTypeKey), err.Error())
+		return
+	}
+	item := object.item(VaultTypeKey)
+	if !*item.Enabled {
+		writeVaultError(w, http.StatusForbidden, "Forbidden", fmt.Sprintf("Operation %s is not allowed on a disabled key.", operation))
+		return
+	}
+	key, err := pemPrivateKey([]byte(object.PEM))
+	if err != nil {
+		writeVaultError(w, http.StatusBadRequest, "BadParameter", fmt.Sprintf("key %s has no private key in the fixture: %s", name, err))
+		return
+	}
+
+	var req agentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeVaultError(w, http.StatusBadRequest, "BadParameter", fmt.Sprintf("invalid request body: %s", err))
+		return
+	}
+	value, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Value, "="))
+	var digest []byte
+	if err == nil && operation == agentVerify {
+		digest, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Digest, "="))
+	}
+	if err != nil {
+		writeVaultError(w, http.StatusBadRequest, "BadParameter", fmt.Sprintf("invalid base64url value: %s", err))
+		return
+	}
+
+	var result []byte
+	switch operation {
+	case agentSign:
+		result, err = signDigest(key, req.Algorithm, value)
+	case agentVerify:
+		writeJSON(w, http.StatusOK, map[string]bool{"value": verifyDigest(key.Public(), req.Algorithm, digest, value) == nil})
+		return
+	case agentWrapKey, agentEncrypt:
+		result, err = encryptKey(key.Public(), req.Algorithm, value)
+	case agentUnwrapKey, agentDecrypt:
+		result, err = decryptKey(key, req.Algorithm, value)
+	default:
+		writeVaultError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("unknown key operation %s", operation))
+		return
+	}
+	if err != nil {
+		writeVaultError(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+	glog.V(2).Infof("emulator: %s with key %s/%s and algorithm %s", operation, name, object.Version, req.Algorithm)
+	writeJSON(w, http.StatusOK, map[string]string{"kid": emulator.objectID(item), "value": base64.RawURLEncoding.EncodeToString(result)})
+}
+
+// writeList writes a page of items, starting at $skiptoken
+func (emulator *Emulator) writeList(w http.ResponseWriter, r *http.Request, items []ObjectItem) {
+	query := r.URL.Query()
+	pageSize := emulator.pageSize
+	if maxResults, err := strconv.Atoi(query.Get("maxresults")); err == nil && maxResults > 0 && maxResults < pageSize {
+		pageSize = maxResults
+	}
+	skip, _ := strconv.Atoi(query.Get("$skiptoken"))
+	if skip < 0 || skip > len(items) {
+		skip = len(items)
+	}
+	end := skip + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+
+	versions := strings.HasSuffix(r.URL.Path, "/versions")
+	values := []map[string]interface{}{}
+	for _, item := range items[skip:end] {
+		value := emulator.itemJSON(item)
+		if !versions {
+			// items of a collection identify the object, not a version
+			for _, key := range []string{"id", "kid"} {
+				if id, ok := value[key].(string); ok {
+					value[key] = strings.TrimSuffix(id, "/"+item.Version)
+				}
+			}
+		}
+		values = append(values, value)
+	}
+	body := map[string]interface{}{"value": values}
+	if end < len(items) {
+		next := *r.URL
+		nextQuery := next.Query()
+		nextQuery.Set("$skiptoken", strconv.Itoa(end))
+		nextQuery.Set("maxresults", strconv.Itoa(pageSize))
+		next.RawQuery = nextQuery.Encode()
+		body["nextLink"] = strings.TrimSuffix(emulator.vaultURL, "/") + next.RequestURI()
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// objectID returns the identifier of an object version, https://<vault>/<collection>/<name>/<version>
+func (emulator *Emulator) objectID(item ObjectItem) string {
+	collection := ""
+	for name, objectType := range emulatorCollections {
+		if objectType == item.Type {
+			collection = name
+		}
+	}
+	return fmt.Sprintf("%s%s/%s/%s", emulator.vaultURL, collection, item.Name, item.Version)
+}
+
+// itemJSON returns the identifier, attributes and tags of an object version
+func (emulator *Emulator) itemJSON(item ObjectItem) map[string]interface{} {
+	id := emulator.objectID(item)
+	attributes := map[string]interface{}{"enabled": item.Enabled == nil || *item.Enabled}
+	for key, value := range map[string]*time.Time{"created": item.Created, "updated": item.Updated, "nbf": item.NotBefore, "exp": item.Expires} {
+		if value != nil {
+			attributes[key] = value.Unix()
+		}
+	}
+	body := map[string]interface{}{"attributes": attributes, "tags": item.Tags}
+	if item.Type == VaultTypeKey {
+		body["kid"] = id
+	} else {
+		body["id"] = id
+	}
+	return body
+}
+
+func notFoundCode(objectType string) string {
+	switch objectType {
+	case VaultTypeKey:
+		return "KeyNotFound"
+	case VaultTypeCertificate:
+		return "CertificateNotFound"
+	default:
+		return "SecretNotFound"
+	}
+}
+
+func writeVaultError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]interface{}{"error": map[string]string{"code": code, "message": message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		glog.Warningf("emulator: failed to write response: %s", err)
+	}
+}
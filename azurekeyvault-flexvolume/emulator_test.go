@@ -0,0 +1,418 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testTenantID     = "00000000-0000-0000-0000-000000000000"
+	testClientID     = "testclient"
+	testClientSecret = "testsecret"
+	testIssuer       = "https://oidc.example.com"
+	testSubject      = "system:serviceaccount:default:nginx"
+)
+
+// testEmulator is an emulator served by test servers
+type testEmulator struct {
+	*Emulator
+	vault    *httptest.Server
+	identity *httptest.Server
+	dir      string
+	client   *http.Client
+
+	mutex sync.Mutex
+	// paths of the requests served, in order
+	paths []string
+}
+
+// record serves the requests with handler and records their paths
+func (test *testEmulator) record(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.mutex.Lock()
+		test.paths = append(test.paths, r.URL.Path)
+		test.mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// startTestEmulator serves an emulator of fixture, configured by configure, and points the shared
+// HTTP client at it
+func startTestEmulator(t *testing.T, fixture FileFixture, configure func(*Emulator)) *testEmulator {
+	dir, err := ioutil.TempDir("", "kv-emulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixturePath := filepath.Join(dir, "fixture.json")
+	if err := ioutil.WriteFile(fixturePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileBackend(context.Background(), Option{filePath: fixturePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emulator := &Emulator{
+		store:            store.(*FileBackend),
+		tenantID:         testTenantID,
+		resource:         "https://vault.azure.net",
+		clientID:         testClientID,
+		clientSecret:     testClientSecret,
+		federatedIssuer:  testIssuer,
+		federatedSubject: testSubject,
+		forbidden:        map[string]bool{},
+		pageSize:         25,
+		tokenLifetime:    emulatorTokenLifetime,
+		tokens:           map[string]time.Time{},
+	}
+	if configure != nil {
+		configure(emulator)
+	}
+
+	test := &testEmulator{Emulator: emulator, dir: dir, client: httpClient}
+	test.vault = httptest.NewTLSServer(test.record(http.HandlerFunc(emulator.serveVault)))
+	emulator.vaultURL = test.vault.URL + "/"
+	identityMux := http.NewServeMux()
+	identityMux.HandleFunc("/metadata/identity/oauth2/token", emulator.serveIMDS)
+	identityMux.HandleFunc("/"+nmipath, emulator.serveNMI)
+	test.identity = httptest.NewServer(test.record(identityMux))
+	if err := emulator.writeEnvironment(filepath.Join(dir, "env.json")); err != nil {
+		t.Fatal(err)
+	}
+	httpClient = test.vault.Client()
+	return test
+}
+
+func (test *testEmulator) stop() {
+	httpClient = test.client
+	test.vault.Close()
+	test.identity.Close()
+	os.RemoveAll(test.dir)
+}
+
+// options returns the options of the azure provider using the emulator with a service principal
+func (test *testEmulator) options() Option {
+	_, nmiPort, _ := net.SplitHostPort(strings.TrimPrefix(test.identity.URL, "http://"))
+	return Option{
+		provider:        ProviderAzure,
+		vaultURL:        test.vaultURL,
+		cloudEnvFile:    filepath.Join(test.dir, "env.json"),
+		identitySystem:  "azure_ad",
+		tenantID:        testTenantID,
+		aADClientID:     testClientID,
+		aADClientSecret: testClientSecret,
+		msiEndpoint:     test.identity.URL + "/metadata/identity/oauth2/token",
+		nmiPort:         nmiPort,
+	}
+}
+
+// testAssertion returns an unsigned service account token with claims
+func testAssertion(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	return fmt.Sprintf("%s.%s.signature", base64.RawURLEncoding.EncodeToString(header), base64.RawURLEncoding.EncodeToString(payload))
+}
+
+func testSecrets(count int) []FileObject {
+	var secrets []FileObject
+	for i := 0; i < count; i++ {
+		secrets = append(secrets, FileObject{Name: fmt.Sprintf("secret%d", i), Version: "1", Value: fmt.Sprintf("value%d", i)})
+	}
+	return secrets
+}
+
+func TestEmulatorAuthentication(t *testing.T) {
+	disabled := false
+	fixture := FileFixture{Secrets: []FileObject{
+		{Name: "db-password", Version: "1", Value: "s3cr3t"},
+		{Name: "private", Version: "1", Value: "private"},
+		{Name: "disabled", Version: "1", Value: "disabled", Enabled: &disabled},
+	}}
+	valid := map[string]interface{}{"aud": []string{csiWorkloadTokenAudience}, "iss": testIssuer, "sub": testSubject, "exp": time.Now().Add(time.Hour).Unix()}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name      string
+		configure func(*Option)
+		secret    string
+		// the expected value, empty when the request fails
+		want string
+		// a part of the expected error
+		wantErr string
+	}{
+		{
+			name:   "service principal",
+			secret: "db-password", want: "s3cr3t",
+		},
+		{
+			name:      "service principal with a wrong secret",
+			configure: func(options *Option) { options.aADClientSecret = "wrong" },
+			secret:    "db-password", wantErr: "invalid client secret",
+		},
+		{
+			name:      "service principal of another client",
+			configure: func(options *Option) { options.aADClientID = "other" },
+			secret:    "db-password", wantErr: "unknown client",
+		},
+		{
+			name: "client assertion",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = testAssertion(valid)
+			},
+			secret: "db-password", want: "s3cr3t",
+		},
+		{
+			name: "client assertion with a string audience",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = testAssertion(with("aud", csiWorkloadTokenAudience))
+			},
+			secret: "db-password", want: "s3cr3t",
+		},
+		{
+			name: "client assertion for another audience",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = testAssertion(with("aud", []string{"vault"}))
+			},
+			secret: "db-password", wantErr: "not for audience",
+		},
+		{
+			name: "client assertion of another subject",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = testAssertion(with("sub", "system:serviceaccount:default:other"))
+			},
+			secret: "db-password", wantErr: "unknown client assertion subject",
+		},
+		{
+			name: "client assertion of another issuer",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = testAssertion(with("iss", "https://attacker.example.com"))
+			},
+			secret: "db-password", wantErr: "unknown client assertion issuer",
+		},
+		{
+			name: "expired client assertion",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = testAssertion(with("exp", time.Now().Add(-time.Minute).Unix()))
+			},
+			secret: "db-password", wantErr: "expired",
+		},
+		{
+			name: "client assertion that is not a JWT",
+			configure: func(options *Option) {
+				options.auth = CredentialWorkloadIdentity
+				options.federatedToken = "not-a-jwt"
+			},
+			secret: "db-password", wantErr: "not a JWT",
+		},
+		{
+			name:      "IMDS",
+			configure: func(options *Option) { options.auth = CredentialManagedIdentity },
+			secret:    "db-password", want: "s3cr3t",
+		},
+		{
+			name: "NMI",
+			configure: func(options *Option) {
+				options.usePodIdentity = true
+				options.podName = "nginx"
+				options.podNamespace = "default"
+			},
+			secret: "db-password", want: "s3cr3t",
+		},
+		{
+			name:      "tenant discovered from the challenge",
+			configure: func(options *Option) { options.tenantID = "" },
+			secret:    "db-password", want: "s3cr3t",
+		},
+		{
+			name:   "forbidden secret",
+			secret: "private", wantErr: "403",
+		},
+		{
+			name:   "disabled secret",
+			secret: "disabled", wantErr: "403",
+		},
+		{
+			name:   "unknown secret",
+			secret: "unknown", wantErr: "404",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			emulator := startTestEmulator(t, fixture, func(emulator *Emulator) { emulator.forbidden["secret/private"] = true })
+			defer emulator.stop()
+			options := emulator.options()
+			if test.configure != nil {
+				test.configure(&options)
+			}
+
+			ctx := context.Background()
+			var bundle *ObjectBundle
+			backend, err := newBackend(ctx, options)
+			if err == nil {
+				bundle, err = backend.GetSecret(ctx, test.secret, "")
+			}
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetSecret(%s): %s", test.secret, err)
+			}
+			if string(bundle.Value) != test.want {
+				t.Errorf("GetSecret(%s) = %q, want %q", test.secret, bundle.Value, test.want)
+			}
+		})
+	}
+}
+
+func TestEmulatorPaging(t *testing.T) {
+	tests := []struct {
+		name     string
+		secrets  int
+		pageSize int
+	}{
+		{name: "single page", secrets: 3, pageSize: 25},
+		{name: "full pages", secrets: 6, pageSize: 2},
+		{name: "last page partial", secrets: 7, pageSize: 3},
+		{name: "empty", secrets: 0, pageSize: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			emulator := startTestEmulator(t, FileFixture{Secrets: testSecrets(test.secrets)}, func(emulator *Emulator) { emulator.pageSize = test.pageSize })
+			defer emulator.stop()
+
+			ctx := context.Background()
+			backend, err := newBackend(ctx, emulator.options())
+			if err != nil {
+				t.Fatal(err)
+			}
+			items, err := backend.List(ctx, VaultTypeSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != test.secrets {
+				t.Fatalf("List returned %d secrets, want %d", len(items), test.secrets)
+			}
+			seen := map[string]bool{}
+			for _, item := range items {
+				seen[item.Name] = true
+			}
+			for _, secret := range testSecrets(test.secrets) {
+				if !seen[secret.Name] {
+					t.Errorf("secret %s is not listed", secret.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestEmulatorThrottling(t *testing.T) {
+	emulator := startTestEmulator(t, FileFixture{Secrets: testSecrets(1)}, func(emulator *Emulator) { emulator.throttleEvery = 2 })
+	defer emulator.stop()
+
+	ctx := context.Background()
+	backend, err := newBackend(ctx, emulator.options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second request is answered with 429 and retried
+	for i := 0; i < 2; i++ {
+		bundle, err := backend.GetSecret(ctx, "secret0", "")
+		if err != nil {
+			t.Fatalf("GetSecret %d: %s", i, err)
+		}
+		if string(bundle.Value) != "value0" {
+			t.Errorf("GetSecret %d = %q, want %q", i, bundle.Value, "value0")
+		}
+	}
+	if emulator.requests != 3 {
+		t.Errorf("the emulator served %d requests, want 3 with the retry", emulator.requests)
+	}
+}
+
+func TestEmulatorChallenge(t *testing.T) {
+	emulator := startTestEmulator(t, FileFixture{}, nil)
+	defer emulator.stop()
+
+	env, err := ParseAzureEnvironment("", filepath.Join(emulator.dir, "env.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := discoverBearerChallenge(emulator.vaultURL, env, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge.TenantID != testTenantID || challenge.Resource != "https://vault.azure.net" || challenge.ActiveDirectoryEndpoint != emulator.vaultURL {
+		t.Errorf("challenge = %+v", challenge)
+	}
+
+	// the authority of the emulator is only trusted when it is the AAD endpoint of the environment
+	other := *env
+	other.ActiveDirectoryEndpoint = "https://login.microsoftonline.com/"
+	if _, err := discoverBearerChallenge(emulator.vaultURL, &other, true); err == nil {
+		t.Errorf("the challenge authority %s is trusted without being the AAD endpoint", emulator.vaultURL)
+	}
+	other = *env
+	other.ResourceIdentifiers.KeyVault = "https://vault.example.com"
+	if _, err := discoverBearerChallenge(emulator.vaultURL, &other, true); err == nil {
+		t.Errorf("the challenge resource is accepted for another resource of the environment")
+	}
+}
+
+func TestEmulatorTokenExpiry(t *testing.T) {
+	emulator := startTestEmulator(t, FileFixture{}, func(emulator *Emulator) { emulator.tokenLifetime = -time.Second })
+	defer emulator.stop()
+
+	expired := emulator.issueToken(testClientID, emulator.resource)
+	req := httptest.NewRequest("GET", emulator.vaultURL+"secrets", nil)
+	req.Header.Set("Authorization", "Bearer "+expired.AccessToken)
+	if emulator.authorized(req) {
+		t.Errorf("an expired token is authorized")
+	}
+
+	emulator.tokenLifetime = time.Hour
+	valid := emulator.issueToken(testClientID, emulator.resource)
+	req.Header.Set("Authorization", "Bearer "+valid.AccessToken)
+	if !emulator.authorized(req) {
+		t.Errorf("a valid token is not authorized")
+	}
+	if _, ok := emulator.tokens[expired.AccessToken]; ok || len(emulator.tokens) != 1 {
+		t.Errorf("the expired tokens are kept: %d tokens", len(emulator.tokens))
+	}
+}
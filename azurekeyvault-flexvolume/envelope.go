@@ -0,0 +1,169 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// envelopeMagic is the first line of an encrypted file
+const envelopeMagic = "KVENVELOPE1\n"
+
+// envelopeKeySize is the size of the AES-256 data encryption key of an encrypted file
+const envelopeKeySize = 32
+
+// EnvelopeHeader is the second line of an encrypted file, followed by the AES-GCM ciphertext of
+// the content. The magic and header lines are authenticated with the content.
+type EnvelopeHeader struct {
+	// name and version of the key that wrapped the data encryption key
+	Key     string `json:"key"`
+	Version string `json:"version"`
+	// algorithm of the wrap, RSA-OAEP-256 by default
+	Algorithm string `json:"alg"`
+	// base64url encoded wrapped data encryption key and AES-GCM nonce
+	WrappedKey string `json:"wrappedKey"`
+	Nonce      string `json:"nonce"`
+}
+
+// KeyUnwrapper is implemented by the backends that can unwrap keys with the private part of a key
+type KeyUnwrapper interface {
+	// UnwrapKey decrypts a key wrapped with a key of the backend
+	UnwrapKey(ctx context.Context, name, version, alg string, wrapped []byte) ([]byte, error)
+}
+
+// getEncryptedFile decrypts the encrypted file at path with a key of backend
+func getEncryptedFile(ctx context.Context, backend Backend, path string) (*ObjectBundle, error) {
+	unwrapper, ok := backend.(KeyUnwrapper)
+	if !ok {
+		return nil, fmt.Errorf("the provider cannot unwrap keys, %s objects are not supported", VaultTypeEncryptedFile)
+	}
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("the path of an %s object must be absolute, got %s", VaultTypeEncryptedFile, path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	header, plaintext, err := decryptEnvelope(ctx, unwrapper, content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt %s", path)
+	}
+	return &ObjectBundle{
+		ObjectItem: ObjectItem{Type: VaultTypeEncryptedFile, Name: path, Version: header.Version},
+		Value:      plaintext,
+	}, nil
+}
+
+// encryptedFileName is the file written for an encrypted file without alias: its name without the .enc extension
+func encryptedFileName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".enc")
+}
+
+// decryptEnvelope unwraps the data encryption key of an encrypted file and decrypts its content
+func decryptEnvelope(ctx context.Context, unwrapper KeyUnwrapper, content []byte) (*EnvelopeHeader, []byte, error) {
+	if !bytes.HasPrefix(content, []byte(envelopeMagic)) {
+		return nil, nil, fmt.Errorf("not an encrypted file, the first line is not %s", strings.TrimSpace(envelopeMagic))
+	}
+	end := bytes.IndexByte(content[len(envelopeMagic):], '\n')
+	if end < 0 {
+		return nil, nil, fmt.Errorf("the header is not terminated")
+	}
+	end += len(envelopeMagic) + 1
+
+	var header EnvelopeHeader
+	if err := json.Unmarshal(content[len(envelopeMagic):end], &header); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid header")
+	}
+	if header.Key == "" || header.Version == "" {
+		return nil, nil, fmt.Errorf("the header has no key name or version")
+	}
+	if header.Algorithm == "" {
+		header.Algorithm = algorithmRSAOAEP256
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.WrappedKey, "="))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid wrapped key")
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.Nonce, "="))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid nonce")
+	}
+
+	dataKey, err := unwrapper.UnwrapKey(ctx, header.Key, header.Version, header.Algorithm, wrappedKey)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to unwrap the data encryption key with key %s (version: %s)", header.Key, header.Version)
+	}
+	gcm, err := envelopeCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, nil, fmt.Errorf("the nonce must be %d bytes", gcm.NonceSize())
+	}
+	plaintext, err := gcm.Open(nil, nonce, content[end:], content[:end])
+	if err != nil {
+		return nil, nil, fmt.Errorf("the content or the header was modified or was not encrypted with this key")
+	}
+	return &header, plaintext, nil
+}
+
+// encryptEnvelope encrypts plaintext with a new data encryption key, wrapped with the public key of a key version
+func encryptEnvelope(publicKey crypto.PublicKey, name, version string, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, envelopeKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := encryptKey(publicKey, algorithmRSAOAEP256, dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to wrap the data encryption key")
+	}
+	gcm, err := envelopeCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(EnvelopeHeader{
+		Key:        name,
+		Version:    version,
+		Algorithm:  algorithmRSAOAEP256,
+		WrappedKey: base64.RawURLEncoding.EncodeToString(wrappedKey),
+		Nonce:      base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return nil, err
+	}
+	content := append([]byte(envelopeMagic), header...)
+	content = append(content, '\n')
+	return gcm.Seal(content, nonce, plaintext, content), nil
+}
+
+// envelopeCipher returns the AES-GCM cipher of a data encryption key
+func envelopeCipher(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != envelopeKeySize {
+		return nil, fmt.Errorf("the data encryption key must be %d bytes", envelopeKeySize)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
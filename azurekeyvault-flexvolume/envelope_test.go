@@ -0,0 +1,160 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &FileBackend{objects: map[string]map[string][]FileObject{}}
+	backend.add(VaultTypeKey, FileObject{Name: "wrap", Version: "1", PEM: testKeyPEM(t, key)})
+	ctx := context.Background()
+
+	plaintext := []byte("db-password=s3cret\n")
+	content, err := encryptEnvelope(&key.PublicKey, "wrap", "1", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, plaintext) {
+		t.Fatalf("the encrypted file holds the plaintext")
+	}
+	header, decrypted, err := decryptEnvelope(ctx, backend, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted = %q, want %q", decrypted, plaintext)
+	}
+	if header.Key != "wrap" || header.Version != "1" || header.Algorithm != algorithmRSAOAEP256 {
+		t.Errorf("header = %+v", header)
+	}
+	again, err := encryptEnvelope(&key.PublicKey, "wrap", "1", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, content) {
+		t.Errorf("two encryptions of the same content are equal")
+	}
+
+	headerEnd := len(envelopeMagic) + bytes.IndexByte(content[len(envelopeMagic):], '\n') + 1
+	tamper := func(f func(content []byte) []byte) []byte {
+		return f(append([]byte{}, content...))
+	}
+	otherContent, err := encryptEnvelope(&otherKey.PublicKey, "wrap", "1", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		// a part of the expected error
+		wantErr string
+	}{
+		{
+			name: "tampered header",
+			content: tamper(func(content []byte) []byte {
+				return bytes.Replace(content, []byte(`{"key"`), []byte(`{"owner":"attacker","key"`), 1)
+			}),
+			wantErr: "was modified",
+		},
+		{
+			name:    "tampered magic",
+			content: tamper(func(content []byte) []byte { return append([]byte("KVENVELOPE2\n"), content[len(envelopeMagic):]...) }),
+			wantErr: "not an encrypted file",
+		},
+		{
+			name: "tampered ciphertext",
+			content: tamper(func(content []byte) []byte {
+				content[headerEnd] ^= 1
+				return content
+			}),
+			wantErr: "was modified",
+		},
+		{
+			name:    "truncated ciphertext",
+			content: content[:len(content)-1],
+			wantErr: "was modified",
+		},
+		{
+			name: "another version",
+			content: tamper(func(content []byte) []byte {
+				return bytes.Replace(content, []byte(`"version":"1"`), []byte(`"version":"2"`), 1)
+			}),
+			wantErr: "failed to unwrap",
+		},
+		{name: "another key", content: otherContent, wantErr: "failed to unwrap"},
+		{name: "plaintext", content: plaintext, wantErr: "not an encrypted file"},
+		{name: "unterminated header", content: []byte(envelopeMagic + `{"key":"wrap"}`), wantErr: "not terminated"},
+		{name: "no version", content: []byte(envelopeMagic + `{"key":"wrap"}` + "\n"), wantErr: "no key name or version"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, decrypted, err := decryptEnvelope(ctx, backend, test.content)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want %q", err, test.wantErr)
+			}
+			if decrypted != nil {
+				t.Errorf("decrypted %q from a modified file", decrypted)
+			}
+		})
+	}
+}
+
+func TestGetEncryptedFile(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &FileBackend{objects: map[string]map[string][]FileObject{}}
+	backend.add(VaultTypeKey, FileObject{Name: "wrap", Version: "1", PEM: testKeyPEM(t, key)})
+	content, err := encryptEnvelope(&key.PublicKey, "wrap", "1", []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "kv-envelope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.env.enc")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := getEncryptedFile(context.Background(), backend, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bundle.Value) != "s3cret" || bundle.Name != path || bundle.Version != "1" {
+		t.Errorf("bundle = %+v %q", bundle.ObjectItem, bundle.Value)
+	}
+	if encryptedFileName(path) != "db.env" {
+		t.Errorf("file name = %s, want db.env", encryptedFileName(path))
+	}
+	if _, err := getEncryptedFile(context.Background(), backend, "db.env.enc"); err == nil {
+		t.Errorf("a relative path is accepted")
+	}
+	if _, err := getEncryptedFile(context.Background(), &VaultBackend{}, path); err == nil {
+		t.Errorf("a provider that cannot unwrap keys is accepted")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// Policies of the objects that are expired or not yet valid, selected with -expiryPolicy
+const (
+	// fail the mount
+	ExpiryPolicyRefuse = "refuse"
+	// mount the object with a warning
+	ExpiryPolicyWarn = "warn"
+	// mount the object without checking its validity
+	ExpiryPolicyAllow = "allow"
+)
+
+// defaultExpiryWarningThreshold is how long before their expiry the objects are reported
+const defaultExpiryWarningThreshold = 14 * 24 * time.Hour
+
+// objectValidity returns the validity period of an object, nil when unbounded: the Key Vault
+// attributes of the object narrowed by the X.509 validity of a certificate
+func objectValidity(bundle *ObjectBundle) (notBefore, notAfter *time.Time) {
+	notBefore, notAfter = bundle.NotBefore, bundle.Expires
+	if bundle.Type != VaultTypeCertificate {
+		return notBefore, notAfter
+	}
+	cert, err := x509.ParseCertificate(bundle.Value)
+	if err != nil {
+		return notBefore, notAfter
+	}
+	if notBefore == nil || cert.NotBefore.After(*notBefore) {
+		notBefore = &cert.NotBefore
+	}
+	if notAfter == nil || cert.NotAfter.Before(*notAfter) {
+		notAfter = &cert.NotAfter
+	}
+	return notBefore, notAfter
+}
+
+// checkExpiry applies the expiry policy to an object. The error is set when the policy refuses
+// the object, the warning when it is mounted but invalid or expiring within threshold.
+func checkExpiry(bundle *ObjectBundle, policy string, threshold time.Duration, now time.Time) (warning string, err error) {
+	if policy == ExpiryPolicyAllow {
+		return "", nil
+	}
+	notBefore, notAfter := objectValidity(bundle)
+	var problem string
+	switch {
+	case notAfter != nil && !now.Before(*notAfter):
+		problem = fmt.Sprintf("%s %s expired on %s", bundle.Type, bundle.Name, notAfter.UTC().Format(time.RFC3339))
+	case notBefore != nil && now.Before(*notBefore):
+		problem = fmt.Sprintf("%s %s is not valid before %s", bundle.Type, bundle.Name, notBefore.UTC().Format(time.RFC3339))
+	case notAfter != nil && notAfter.Sub(now) < threshold:
+		return fmt.Sprintf("%s %s expires on %s, in %s", bundle.Type, bundle.Name, notAfter.UTC().Format(time.RFC3339), formatRemaining(notAfter.Sub(now))), nil
+	default:
+		return "", nil
+	}
+	if policy == ExpiryPolicyRefuse {
+		return "", fmt.Errorf("%s, refused by the %s expiry policy", problem, policy)
+	}
+	return problem, nil
+}
+
+// formatRemaining formats a duration in days, or in hours and minutes under a day
+func formatRemaining(remaining time.Duration) string {
+	if remaining >= 24*time.Hour {
+		return fmt.Sprintf("%d days", int(remaining/(24*time.Hour)))
+	}
+	return remaining.Truncate(time.Minute).String()
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	threshold := 14 * 24 * time.Hour
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	secret := func(notBefore, expires *time.Time) *ObjectBundle {
+		return &ObjectBundle{ObjectItem: ObjectItem{Type: VaultTypeSecret, Name: "db-password", NotBefore: notBefore, Expires: expires}}
+	}
+
+	// a certificate valid for 10 days, in an object that expires in a year
+	key, chain := testChain(t, "ecdsa")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "web"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := &ObjectBundle{ObjectItem: ObjectItem{Type: VaultTypeCertificate, Name: "web", Expires: at(365 * 24 * time.Hour)}, Value: der}
+	// the certificates of testChain are valid from an hour before the current time
+	futureCertificate := &ObjectBundle{ObjectItem: ObjectItem{Type: VaultTypeCertificate, Name: "web"}, Value: chain[0].Raw}
+
+	tests := []struct {
+		name   string
+		bundle *ObjectBundle
+		policy string
+		// parts of the expected warning and error, empty when there are none
+		wantWarning string
+		wantErr     string
+	}{
+		{name: "valid", bundle: secret(at(-time.Hour), at(30*24*time.Hour)), policy: ExpiryPolicyRefuse},
+		{name: "no expiry", bundle: secret(nil, nil), policy: ExpiryPolicyRefuse},
+		{name: "expiring with refuse", bundle: secret(nil, at(3*24*time.Hour)), policy: ExpiryPolicyRefuse, wantWarning: "expires on 2020-06-04T12:00:00Z, in 3 days"},
+		{name: "expiring with warn", bundle: secret(nil, at(90*time.Minute)), policy: ExpiryPolicyWarn, wantWarning: "in 1h30m0s"},
+		{name: "expiring with allow", bundle: secret(nil, at(time.Hour)), policy: ExpiryPolicyAllow},
+		{name: "at the threshold", bundle: secret(nil, at(threshold)), policy: ExpiryPolicyWarn},
+		{name: "just under the threshold", bundle: secret(nil, at(threshold-time.Second)), policy: ExpiryPolicyWarn, wantWarning: "in 13 days"},
+		{name: "expired with refuse", bundle: secret(nil, at(-time.Hour)), policy: ExpiryPolicyRefuse, wantErr: "secret db-password expired on 2020-06-01T11:00:00Z, refused by the refuse expiry policy"},
+		{name: "expired with warn", bundle: secret(nil, at(-time.Hour)), policy: ExpiryPolicyWarn, wantWarning: "expired on 2020-06-01T11:00:00Z"},
+		{name: "expired with allow", bundle: secret(nil, at(-time.Hour)), policy: ExpiryPolicyAllow},
+		{name: "expiring now", bundle: secret(nil, at(0)), policy: ExpiryPolicyRefuse, wantErr: "expired on 2020-06-01T12:00:00Z"},
+		{name: "not yet valid with refuse", bundle: secret(at(time.Hour), nil), policy: ExpiryPolicyRefuse, wantErr: "is not valid before 2020-06-01T13:00:00Z"},
+		{name: "not yet valid with warn", bundle: secret(at(time.Hour), nil), policy: ExpiryPolicyWarn, wantWarning: "is not valid before"},
+		{name: "certificate validity narrower than the object", bundle: certificate, policy: ExpiryPolicyWarn, wantWarning: "cert web expires on 2020-06-11T12:00:00Z, in 10 days"},
+		{name: "certificate not yet valid without attributes", bundle: futureCertificate, policy: ExpiryPolicyRefuse, wantErr: "cert web is not valid before"},
+		{name: "invalid certificate uses the attributes", bundle: &ObjectBundle{ObjectItem: ObjectItem{Type: VaultTypeCertificate, Name: "web", Expires: at(time.Hour)}, Value: []byte("invalid")}, policy: ExpiryPolicyWarn, wantWarning: "in 1h0m0s"},
+		{name: "key", bundle: &ObjectBundle{ObjectItem: ObjectItem{Type: VaultTypeKey, Name: "signing", Expires: at(-time.Hour)}}, policy: ExpiryPolicyRefuse, wantErr: "key signing expired"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			warning, err := checkExpiry(test.bundle, test.policy, threshold, now)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("checkExpiry: %s", err)
+			}
+			if (test.wantWarning == "") != (warning == "") || !strings.Contains(warning, test.wantWarning) {
+				t.Errorf("warning = %q, want %q", warning, test.wantWarning)
+			}
+		})
+	}
+}
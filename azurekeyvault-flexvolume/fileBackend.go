@@ -0,0 +1,353 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// FileBackend is the Backend of a node-local directory tree or fixture file, for development
+// clusters without a vault. The tree has a secret, key and cert directory; an object is either a
+// file or a directory of version files, the most recently modified being the current version.
+type FileBackend struct {
+	// objects by type and name, oldest version first
+	objects map[string]map[string][]FileObject
+}
+
+// FileFixture is the content of a JSON or YAML fixture file. Entries with the same name
+// are the versions of an object, the last one being the current version.
+type FileFixture struct {
+	Secrets      []FileObject `json:"secrets"`
+	Keys         []FileObject `json:"keys"`
+	Certificates []FileObject `json:"certificates"`
+}
+
+// FileObject is a version of an object of a fixture
+type FileObject struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	// the value of a secret
+	Value string `json:"value,omitempty"`
+	// the PEM encoded key or certificate
+	PEM         string            `json:"pem,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Enabled     *bool             `json:"enabled,omitempty"`
+	NotBefore   *time.Time        `json:"notBefore,omitempty"`
+	Expires     *time.Time        `json:"expires,omitempty"`
+	Created     *time.Time        `json:"created,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+func newFileBackend(ctx context.Context, options Option) (Backend, error) {
+	info, err := os.Stat(options.filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", options.filePath)
+	}
+	backend := &FileBackend{objects: map[string]map[string][]FileObject{}}
+	if info.IsDir() {
+		err = backend.loadTree(options.filePath)
+	} else {
+		err = backend.loadFixture(options.filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// loadFixture loads a JSON or YAML fixture
+func (backend *FileBackend) loadFixture(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read fixture %s", path)
+	}
+	var fixture FileFixture
+	if err := yaml.Unmarshal(content, &fixture); err != nil {
+		return errors.Wrapf(err, "failed to parse fixture %s", path)
+	}
+	for objectType, objects := range map[string][]FileObject{
+		VaultTypeSecret:      fixture.Secrets,
+		VaultTypeKey:         fixture.Keys,
+		VaultTypeCertificate: fixture.Certificates,
+	} {
+		for _, object := range objects {
+			if object.Name == "" {
+				return fmt.Errorf("fixture %s has a %s without name", path, objectType)
+			}
+			backend.add(objectType, object)
+		}
+	}
+	return nil
+}
+
+// loadTree loads the <root>/<type>/<name>[/<version>] files
+func (backend *FileBackend) loadTree(root string) error {
+	for _, objectType := range []string{VaultTypeSecret, VaultTypeKey, VaultTypeCertificate} {
+		entries, err := ioutil.ReadDir(filepath.Join(root, objectType))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s objects", objectType)
+		}
+		for _, entry := range entries {
+			objectPath := filepath.Join(root, objectType, entry.Name())
+			versions := []os.FileInfo{entry}
+			if entry.IsDir() {
+				if versions, err = ioutil.ReadDir(objectPath); err != nil {
+					return errors.Wrapf(err, "failed to read versions of %s", objectPath)
+				}
+				sort.SliceStable(versions, func(i, j int) bool {
+					return versions[i].ModTime().Before(versions[j].ModTime())
+				})
+			}
+			for _, version := range versions {
+				versionPath := objectPath
+				object := FileObject{Name: entry.Name()}
+				if entry.IsDir() {
+					versionPath = filepath.Join(objectPath, version.Name())
+					object.Version = version.Name()
+				}
+				content, err := ioutil.ReadFile(versionPath)
+				if err != nil {
+					return errors.Wrapf(err, "failed to read %s", versionPath)
+				}
+				if objectType == VaultTypeSecret {
+					object.Value = string(content)
+				} else {
+					object.PEM = string(content)
+				}
+				modified := version.ModTime()
+				object.Created = &modified
+				backend.add(objectType, object)
+			}
+		}
+	}
+	return nil
+}
+
+// add appends a version to an object, unversioned objects are versioned by their content
+func (backend *FileBackend) add(objectType string, object FileObject) {
+	if object.Version == "" {
+		sum := sha256.Sum256([]byte(object.Value + object.PEM))
+		object.Version = hex.EncodeToString(sum[:8])
+	}
+	if backend.objects[objectType] == nil {
+		backend.objects[objectType] = map[string][]FileObject{}
+	}
+	backend.objects[objectType][object.Name] = append(backend.objects[objectType][object.Name], object)
+}
+
+// get returns a version of an object, the current one when version is empty
+func (backend *FileBackend) get(objectType, name, version string) (*FileObject, error) {
+	versions := backend.objects[objectType][name]
+	if len(versions) == 0 {
+		return nil, &BackendError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("%s %s not found", objectType, name)}
+	}
+	if version == "" {
+		return &versions[len(versions)-1], nil
+	}
+	for i := range versions {
+		if versions[i].Version == version {
+			return &versions[i], nil
+		}
+	}
+	return nil, &BackendError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("%s %s version %s not found", objectType, name, version)}
+}
+
+// GetSecret returns the value of a secret
+func (backend *FileBackend) GetSecret(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	object, err := backend.get(VaultTypeSecret, name, version)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectBundle{
+		ObjectItem:  object.item(VaultTypeSecret),
+		Value:       []byte(object.Value),
+		ContentType: object.ContentType,
+	}, nil
+}
+
+// GetKey returns the public part of a PEM encoded RSA or EC key, public or private
+func (backend *FileBackend) GetKey(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	object, err := backend.get(VaultTypeKey, name, version)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pemPublicKey([]byte(object.PEM))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %s", name)
+	}
+	jwk, err := publicJSONWebKey(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %s", name)
+	}
+	jwk.Kid = name + "/" + object.Version
+	return &ObjectBundle{ObjectItem: object.item(VaultTypeKey), Key: jwk}, nil
+}
+
+// UnwrapKey unwraps a key with a PEM encoded private RSA key
+func (backend *FileBackend) UnwrapKey(ctx context.Context, name, version, alg string, wrapped []byte) ([]byte, error) {
+	object, err := backend.get(VaultTypeKey, name, version)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pemPrivateKey([]byte(object.PEM))
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %s has no private key", name)
+	}
+	return decryptKey(key, alg, wrapped)
+}
+
+// GetCertificate returns the DER encoded certificate of a PEM or DER file
+func (backend *FileBackend) GetCertificate(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	object, err := backend.get(VaultTypeCertificate, name, version)
+	if err != nil {
+		return nil, err
+	}
+	der := []byte(object.PEM)
+	for rest := der; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			der = block.Bytes
+			break
+		}
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return nil, errors.Wrapf(err, "invalid certificate %s", name)
+	}
+	return &ObjectBundle{ObjectItem: object.item(VaultTypeCertificate), Value: der}, nil
+}
+
+// List returns the objects of a type
+func (backend *FileBackend) List(ctx context.Context, objectType string) ([]ObjectItem, error) {
+	var items []ObjectItem
+	for _, versions := range backend.objects[objectType] {
+		items = append(items, versions[len(versions)-1].item(objectType))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+// Versions returns the versions of an object, oldest first
+func (backend *FileBackend) Versions(ctx context.Context, objectType, name string) ([]ObjectItem, error) {
+	versions := backend.objects[objectType][name]
+	if len(versions) == 0 {
+		return nil, &BackendError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("%s %s not found", objectType, name)}
+	}
+	var items []ObjectItem
+	for _, object := range versions {
+		items = append(items, object.item(objectType))
+	}
+	return items, nil
+}
+
+// item describes the version of the object, enabled unless stated otherwise
+func (object *FileObject) item(objectType string) ObjectItem {
+	enabled := object.Enabled == nil || *object.Enabled
+	return ObjectItem{
+		Type:      objectType,
+		Name:      object.Name,
+		Version:   object.Version,
+		Enabled:   &enabled,
+		Created:   object.Created,
+		NotBefore: object.NotBefore,
+		Expires:   object.Expires,
+		Tags:      object.Tags,
+	}
+}
+
+// pemPublicKey returns the public key of the first PEM encoded RSA or EC key
+func pemPublicKey(content []byte) (interface{}, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public(), nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public(), nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key.Public(), nil
+		case *ecdsa.PrivateKey:
+			return key.Public(), nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+}
+
+// publicJSONWebKey encodes an RSA or EC public key as a JSON web key
+func publicJSONWebKey(key interface{}) (*JSONWebKey, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return &JSONWebKey{
+			Kty: "RSA",
+			N:   encode(key.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return &JSONWebKey{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   encode(padBytes(key.X.Bytes(), size)),
+			Y:   encode(padBytes(key.Y.Bytes(), size)),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// padBytes left pads b with zeros to size bytes
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
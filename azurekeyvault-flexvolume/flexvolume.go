@@ -0,0 +1,352 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// FlexVolume driver calls, see https://github.com/kubernetes/community/blob/master/contributors/devel/sig-storage/flexvolume.md
+const (
+	driverInit          = "init"
+	driverMount         = "mount"
+	driverUnmount       = "unmount"
+	driverGetVolumeName = "getvolumename"
+)
+
+// Status of a FlexVolume driver call
+const (
+	driverStatusSuccess      = "Success"
+	driverStatusFailure      = "Failure"
+	driverStatusNotSupported = "Not supported"
+)
+
+const (
+	// flags of the driver with the settings of the node, next to the driver executable
+	driverConfigName             = "kv.conf"
+	driverLogDir                 = "/var/log/kv-driver"
+	driverMountDirPermission     = 0750
+	flexVolumeSecretClientID     = "kubernetes.io/secret/clientid"
+	flexVolumeSecretClientSecret = "kubernetes.io/secret/clientsecret"
+)
+
+// flexVolumeFlags maps the flexVolume options of the pod spec to the flags of the driver. It is the
+// allowlist of the options a volume can set, the settings of the node are flags of the driver.
+var flexVolumeFlags = map[string]string{
+	"provider":                    "provider",
+	"agent":                       "agent",
+	"sshagent":                    "sshAgent",
+	"keyvaultname":                "vaultName",
+	"keyvaulturl":                 "vaultURL",
+	"keyvaultobjectnames":         "vaultObjectNames",
+	"keyvaultobjectaliases":       "vaultObjectAliases",
+	"keyvaultobjecttypes":         "vaultObjectTypes",
+	"keyvaultobjectversions":      "vaultObjectVersions",
+	"keyvaultobjectverifywith":    "vaultObjectVerifyWith",
+	"keyvaultobjectformats":       "vaultObjectFormats",
+	"keyvaultobjectlayouts":       "vaultObjectLayouts",
+	"keystorepasswordsecret":      "keystorePasswordSecret",
+	"truststore":                  "truststore",
+	"truststorecerts":             "truststoreCerts",
+	"truststoreformat":            "truststoreFormat",
+	"expirypolicy":                "expiryPolicy",
+	"expirywarningthreshold":      "expiryWarningThreshold",
+	"tenantid":                    "tenantId",
+	"cloudname":                   "cloudName",
+	"identitysystem":              "identitySystem",
+	"usepodidentity":              "usePodIdentity",
+	"usevmmanagedidentity":        "useVmManagedIdentity",
+	"vmmanagedidentityclientid":   "vmManagedIdentityClientID",
+	"vmmanagedidentityresourceid": "vmManagedIdentityResourceID",
+	"vmmanagedidentityobjectid":   "vmManagedIdentityObjectID",
+	"auth":                        "auth",
+	"nmiport":                     "nmiPort",
+	"vaultaddr":                   "vaultAddr",
+	"vaultrole":                   "vaultRole",
+	"vaultauthpath":               "vaultAuthPath",
+	"vaultkvpath":                 "vaultKVPath",
+	"vaultpkipath":                "vaultPKIPath",
+	"vaultpkirole":                "vaultPKIRole",
+	"filepath":                    "filePath",
+	"kubernetes.io/pod.name":      "podName",
+	"kubernetes.io/pod.namespace": "podNamespace",
+	flexVolumeSecretClientID:      "aADClientID",
+	flexVolumeSecretClientSecret:  "aADClientSecret",
+}
+
+// flexVolumeLegacyOptions are the single object options, used when the list options are not set
+// backward compatibility (should be deprecated!)
+var flexVolumeLegacyOptions = map[string]string{
+	"keyvaultobjectname":    "keyvaultobjectnames",
+	"keyvaultobjecttype":    "keyvaultobjecttypes",
+	"keyvaultobjectversion": "keyvaultobjectversions",
+}
+
+// DriverCapabilities are the capabilities reported on init
+type DriverCapabilities struct {
+	Attach bool `json:"attach"`
+}
+
+// DriverStatus is the result of a driver call, printed as JSON for the kubelet
+type DriverStatus struct {
+	Status       string              `json:"status"`
+	Message      string              `json:"message,omitempty"`
+	Capabilities *DriverCapabilities `json:"capabilities,omitempty"`
+}
+
+// isDriverCall returns true when the driver is executed by the kubelet as a FlexVolume driver
+func isDriverCall(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case driverInit, driverMount, driverUnmount, driverGetVolumeName:
+		return true
+	}
+	return false
+}
+
+// runDriver executes a FlexVolume driver call, prints its status and returns the exit code.
+// The kubelet parses the combined output of the driver, nothing else can be written to stdout or stderr.
+func runDriver(args []string) int {
+	setupDriverLogging()
+
+	status := driverCall(args[0], args[1:])
+	if status.Status == driverStatusFailure {
+		glog.Errorf("%s failed: %s", args[0], status.Message)
+	}
+	glog.Flush()
+
+	out, err := json.Marshal(status)
+	if err != nil {
+		out = []byte(fmt.Sprintf(`{"status": "%s", "message": "failed to marshal status"}`, driverStatusFailure))
+	}
+	fmt.Println(string(out))
+
+	if status.Status == driverStatusFailure {
+		return 1
+	}
+	return 0
+}
+
+// setupDriverLogging sends the logs to files only
+func setupDriverLogging() {
+	if err := os.MkdirAll(driverLogDir, driverMountDirPermission); err == nil {
+		_ = flag.Set("log_dir", driverLogDir)
+	}
+	_ = flag.Set("logtostderr", "false")
+	_ = flag.Set("stderrthreshold", "FATAL")
+	_ = flag.CommandLine.Parse([]string{})
+}
+
+func driverCall(command string, args []string) DriverStatus {
+	glog.V(2).Infof("driver call: %s", command)
+	switch command {
+	case driverInit:
+		return DriverStatus{Status: driverStatusSuccess, Capabilities: &DriverCapabilities{Attach: false}}
+	case driverMount:
+		if len(args) < 2 {
+			return driverFailure(fmt.Errorf("usage: %s <mount dir> <json params>", driverMount))
+		}
+		return mountVolume(args[0], args[1])
+	case driverUnmount:
+		if len(args) < 1 {
+			return driverFailure(fmt.Errorf("usage: %s <mount dir>", driverUnmount))
+		}
+		return unmountVolume(args[0])
+	default:
+		// the kubelet falls back to its own volume naming
+		return DriverStatus{Status: driverStatusNotSupported}
+	}
+}
+
+func mountVolume(dir, jsonParams string) DriverStatus {
+	params, err := flexVolumeParams(jsonParams)
+	if err != nil {
+		return driverFailure(errors.Wrap(err, "validation failed"))
+	}
+	node, err := driverNodeOptions()
+	if err != nil {
+		return driverFailure(err)
+	}
+	options, err := optionsFromParams(params, *node)
+	if err != nil {
+		return driverFailure(errors.Wrap(err, "validation failed"))
+	}
+	options.dir = dir
+	if err := Validate(*options); err != nil {
+		return driverFailure(errors.Wrap(err, "validation failed"))
+	}
+
+	mounted, err := isMounted(dir)
+	if err != nil {
+		return driverFailure(err)
+	}
+	if mounted {
+		glog.V(2).Infof("%s is already mounted", dir)
+		return DriverStatus{Status: driverStatusSuccess}
+	}
+
+	if err := configureHTTPClient(options.transport); err != nil {
+		return driverFailure(err)
+	}
+
+	if err := os.MkdirAll(dir, driverMountDirPermission); err != nil {
+		return driverFailure(errors.Wrapf(err, "failed to mkdir at %s", dir))
+	}
+	if err := mountTmpfs(dir); err != nil {
+		return driverFailure(errors.Wrapf(err, "failed to mount at %s", dir))
+	}
+
+	adapter := &KeyvaultFlexvolumeAdapter{ctx: context.Background(), options: *options}
+	if options.agent || options.sshAgent {
+		err = startAgent(dir, params, "", *node)
+	} else {
+		err = adapter.Run()
+	}
+	if err != nil {
+		if err := unmountTmpfs(dir); err != nil {
+			glog.Errorf("failed to unmount %s: %s", dir, err)
+		}
+		return driverFailure(err)
+	}
+
+	// the kubelet ignores the message of a successful mount, the warnings of the objects are in the driver log
+	return DriverStatus{Status: driverStatusSuccess}
+}
+
+func unmountVolume(dir string) DriverStatus {
+	mounted, err := isMounted(dir)
+	if err != nil {
+		return driverFailure(err)
+	}
+	if !mounted {
+		glog.V(2).Infof("%s is not mounted", dir)
+		return DriverStatus{Status: driverStatusSuccess}
+	}
+
+	stateDir := defaultStateDir
+	if node, err := driverNodeOptions(); err == nil {
+		stateDir = node.StateDir
+	} else {
+		// the wipe never prevents the unmount
+		glog.Errorf("failed to read the settings of the node: %s", err)
+	}
+	stopAgent(dir)
+	report := wipeBeforeUnmount(stateDir, dir)
+	if err := unmountTmpfs(dir); err != nil {
+		return driverFailure(errors.Wrapf(err, "failed to unmount volume at %s", dir))
+	}
+	if err := os.Remove(dir); err != nil {
+		glog.Warningf("failed to remove %s: %s", dir, err)
+	}
+	return DriverStatus{Status: driverStatusSuccess, Message: report}
+}
+
+// flexVolumeParams parses the json params of a mount call into the flexVolume options
+func flexVolumeParams(jsonParams string) (map[string]string, error) {
+	var params map[string]string
+	if err := json.Unmarshal([]byte(jsonParams), &params); err != nil {
+		return nil, errors.Wrap(err, "failed to parse json params")
+	}
+
+	for legacy, option := range flexVolumeLegacyOptions {
+		if params[option] == "" && params[legacy] != "" {
+			params[option] = params[legacy]
+		}
+	}
+
+	// secretRef values are base64 encoded by the kubelet
+	for _, key := range []string{flexVolumeSecretClientID, flexVolumeSecretClientSecret} {
+		if params[key] == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(params[key]), ""))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", key)
+		}
+		params[key] = string(decoded)
+	}
+	return params, nil
+}
+
+// driverNodeOptions reads the settings of the node from the flags in the config file of the driver,
+// written by the installer. Without the file, the settings have their defaults.
+func driverNodeOptions() (*NodeOptions, error) {
+	var node NodeOptions
+	fs := flag.NewFlagSet(program, flag.ContinueOnError)
+	registerNodeFlags(fs, &node)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find the driver executable")
+	}
+	configPath := filepath.Join(filepath.Dir(executable), driverConfigName)
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read %s", configPath)
+	}
+	if err := fs.Parse(strings.Fields(string(content))); err != nil {
+		return nil, errors.Wrapf(err, "invalid flags in %s", configPath)
+	}
+	return &node, nil
+}
+
+// optionsFromParams sets the flags matching the flexVolume options on top of their defaults,
+// and the settings of the node
+func optionsFromParams(params map[string]string, node NodeOptions) (*Option, error) {
+	var options Option
+	fs := flag.NewFlagSet(program, flag.ContinueOnError)
+	registerFlags(fs, &options)
+	// a volume only uses the tokens of its pod, not the ones of the driver
+	options.federatedTokenFile = ""
+	options.vaultToken = ""
+	options.vaultServiceAccountTokenFile = ""
+	for key, value := range params {
+		name, ok := flexVolumeFlags[key]
+		if !ok {
+			// the kubelet adds its own kubernetes.io/ options to every call
+			if _, legacy := flexVolumeLegacyOptions[key]; !legacy && !strings.HasPrefix(key, "kubernetes.io/") {
+				glog.Warningf("ignoring unknown option %s", key)
+			}
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, errors.Wrapf(err, "invalid value for %s", key)
+		}
+	}
+	node.applyTo(&options)
+	if options.provider == ProviderFile && options.filePath != "" {
+		filePath, err := node.fileProviderPath(options.filePath)
+		if err != nil {
+			return nil, err
+		}
+		options.filePath = filePath
+	}
+	return &options, nil
+}
+
+// driverFailure returns a failed status, sanitised like sanitisedError so the kubelet can parse it
+func driverFailure(err error) DriverStatus {
+	return DriverStatus{
+		Status:  driverStatusFailure,
+		Message: strings.Replace(err.Error(), "\\", " ", -1),
+	}
+}
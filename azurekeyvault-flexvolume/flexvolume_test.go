@@ -0,0 +1,165 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDriverCall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+		// the JSON status printed for the kubelet
+		want string
+		// a part of the expected message
+		wantMessage string
+	}{
+		{name: "init", command: driverInit, want: `{"status":"Success","capabilities":{"attach":false}}`},
+		{name: "unmount of a volume not mounted", command: driverUnmount, args: []string{dir}, want: `{"status":"Success"}`},
+		{name: "unmount without dir", command: driverUnmount, wantMessage: "usage: unmount"},
+		{name: "mount without params", command: driverMount, args: []string{dir}, wantMessage: "usage: mount"},
+		{name: "mount with invalid params", command: driverMount, args: []string{dir, "{"}, wantMessage: "failed to parse json params"},
+		{name: "mount with invalid options", command: driverMount, args: []string{dir, `{"keyvaultname": "testvault"}`}, wantMessage: "validation failed"},
+		{name: "getvolumename", command: driverGetVolumeName, want: `{"status":"Not supported"}`},
+		{name: "attach", command: "attach", want: `{"status":"Not supported"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := driverCall(test.command, test.args)
+			if test.wantMessage != "" {
+				if status.Status != driverStatusFailure || !strings.Contains(status.Message, test.wantMessage) {
+					t.Errorf("status = %+v, want a failure with %q", status, test.wantMessage)
+				}
+				return
+			}
+			out, err := json.Marshal(status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != test.want {
+				t.Errorf("status = %s, want %s", out, test.want)
+			}
+		})
+	}
+}
+
+func TestFlexVolumeParams(t *testing.T) {
+	params, err := flexVolumeParams(`{
+		"keyvaultname": "testvault",
+		"keyvaultobjectname": "db-password",
+		"keyvaultobjecttype": "secret",
+		"keyvaultobjectversions": "1",
+		"keyvaultobjectversion": "2",
+		"kubernetes.io/secret/clientid": "Y2xp\nZW50",
+		"kubernetes.io/secret/clientsecret": "c2VjcmV0"
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"keyvaultobjectnames":        "db-password",
+		"keyvaultobjecttypes":        "secret",
+		"keyvaultobjectversions":     "1",
+		flexVolumeSecretClientID:     "client",
+		flexVolumeSecretClientSecret: "secret",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("%s = %q, want %q", key, params[key], value)
+		}
+	}
+
+	if _, err := flexVolumeParams(`{"kubernetes.io/secret/clientsecret": "not base64!"}`); err == nil {
+		t.Errorf("an invalid secret is accepted")
+	}
+	if _, err := flexVolumeParams(`{"keyvaultname": 1}`); err == nil {
+		t.Errorf("a value that is not a string is accepted")
+	}
+}
+
+func TestOptionsFromParams(t *testing.T) {
+	// the tokens of the driver are never the ones of a volume
+	for name, value := range map[string]string{"AZURE_FEDERATED_TOKEN_FILE": "/var/run/driver/token", "VAULT_TOKEN": "driver-token"} {
+		previous, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if set {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	root, err := ioutil.TempDir("", "kv-file-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "fixture.yaml"), []byte("secrets: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	node := NodeOptions{CloudEnvFile: "/etc/kubernetes/azurestack.json", MSIEndpoint: "http://127.0.0.1:8080", FileRoot: root, StateDir: "/var/lib/kv-test"}
+
+	options, err := optionsFromParams(map[string]string{
+		"provider":               "file",
+		"filepath":               "fixture.yaml",
+		"keyvaultobjectnames":    "db-password",
+		"usepodidentity":         "true",
+		"expirypolicy":           "",
+		"kubernetes.io/pod.name": "nginx",
+		flexVolumeSecretClientID: "client",
+		// options that are not in the allowlist never reach the flags
+		"dir":                          "/etc",
+		"stateDir":                     "/tmp",
+		"msiEndpoint":                  "http://attacker",
+		"cloudEnvFile":                 "/etc/shadow",
+		"vaultToken":                   "pod-token",
+		"federatedTokenFile":           "/etc/shadow",
+		"vaultServiceAccountTokenFile": "/etc/shadow",
+		"aadclientsecret":              "secret",
+		"kubernetes.io/fsType":         "",
+	}, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.provider != ProviderFile || options.filePath != filepath.Join(root, "fixture.yaml") || options.vaultObjectNames != "db-password" ||
+		!options.usePodIdentity || options.podName != "nginx" || options.aADClientID != "client" {
+		t.Errorf("the allowed options are not set: %+v", *options)
+	}
+	if options.expiryPolicy != ExpiryPolicyWarn {
+		t.Errorf("expiryPolicy = %q, an empty option keeps the default", options.expiryPolicy)
+	}
+	if options.dir != "" || options.aADClientSecret != "" {
+		t.Errorf("an unknown option is set: dir %q, aADClientSecret %q", options.dir, options.aADClientSecret)
+	}
+	if options.cloudEnvFile != node.CloudEnvFile || options.msiEndpoint != node.MSIEndpoint || options.stateDir != node.StateDir {
+		t.Errorf("the settings of the node are overridden by the volume: %+v", *options)
+	}
+	if options.federatedTokenFile != "" || options.vaultToken != "" || options.vaultServiceAccountTokenFile != "" {
+		t.Errorf("the tokens of the driver are set on the volume: %q %q %q", options.federatedTokenFile, options.vaultToken, options.vaultServiceAccountTokenFile)
+	}
+
+	if _, err := optionsFromParams(map[string]string{"usepodidentity": "maybe"}, node); err == nil {
+		t.Errorf("an invalid value is accepted")
+	}
+	if _, err := optionsFromParams(map[string]string{"provider": "file", "filepath": "../fixture.yaml"}, node); err == nil {
+		t.Errorf("a file outside of the file provider root is accepted")
+	}
+	if _, err := optionsFromParams(map[string]string{"provider": "file", "filepath": "fixture.yaml"}, NodeOptions{}); err == nil {
+		t.Errorf("the file provider is used without -fileProviderRoot")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+)
+
+// JKS keystores, as written by the SUN provider of Java
+const (
+	jksMagic          = 0xfeedfeed
+	jksVersion        = 2
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+	jksCertType       = "X.509"
+	// appended to the password for the digest of the keystore
+	jksWhitener = "Mighty Aphrodite"
+)
+
+// jksKeyProtectorOID is the algorithm of the private keys protected by the SUN key protector
+var jksKeyProtectorOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// jksEntry is a private key and its certificate chain, or a trusted certificate when key is nil
+type jksEntry struct {
+	alias string
+	key   crypto.PrivateKey
+	chain []*x509.Certificate
+}
+
+// encodeJKS encodes entries in a JKS keystore protected by password, the private keys are protected by the same password
+func encodeJKS(entries []jksEntry, password string, now time.Time) ([]byte, error) {
+	passwordBytes := jksPassword(password)
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+
+	var buf bytes.Buffer
+	write := func(value interface{}) {
+		binary.Write(&buf, binary.BigEndian, value)
+	}
+	// strings are written in Java's modified UTF-8, the same as UTF-8 for the aliases and the certificate type
+	writeUTF := func(value string) {
+		write(uint16(len(value)))
+		buf.WriteString(value)
+	}
+	writeBytes := func(value []byte) {
+		write(uint32(len(value)))
+		buf.Write(value)
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(jksVersion))
+	write(uint32(len(entries)))
+	for _, entry := range entries {
+		if entry.key == nil {
+			write(uint32(jksTrustedCertTag))
+			writeUTF(entry.alias)
+			write(timestamp)
+			writeUTF(jksCertType)
+			writeBytes(entry.chain[0].Raw)
+			continue
+		}
+		protectedKey, err := jksProtectKey(entry.key, passwordBytes)
+		if err != nil {
+			return nil, err
+		}
+		write(uint32(jksPrivateKeyTag))
+		writeUTF(entry.alias)
+		write(timestamp)
+		writeBytes(protectedKey)
+		write(uint32(len(entry.chain)))
+		for _, cert := range entry.chain {
+			writeUTF(jksCertType)
+			writeBytes(cert.Raw)
+		}
+	}
+
+	digest := sha1.New()
+	digest.Write(passwordBytes)
+	digest.Write([]byte(jksWhitener))
+	digest.Write(buf.Bytes())
+	buf.Write(digest.Sum(nil))
+	return buf.Bytes(), nil
+}
+
+// jksProtectKey encrypts a private key with the SUN key protector: the PKCS #8 key is XORed with a
+// SHA-1 keystream of the password and a random salt, followed by a SHA-1 check of the password and the key
+func jksProtectKey(key crypto.PrivateKey, passwordBytes []byte) ([]byte, error) {
+	plainKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	protected := append([]byte{}, salt...)
+	digest := salt
+	for offset := 0; offset < len(plainKey); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+		for i := 0; i < sha1.Size && offset+i < len(plainKey); i++ {
+			protected = append(protected, plainKey[offset+i]^digest[i])
+		}
+	}
+	check := sha1.New()
+	check.Write(passwordBytes)
+	check.Write(plainKey)
+	protected = check.Sum(protected)
+
+	return asn1.Marshal(struct {
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}{pkix.AlgorithmIdentifier{Algorithm: jksKeyProtectorOID, Parameters: asn1.NullRawValue}, protected})
+}
+
+// jksPassword returns the password as Java chars, UTF-16 big endian
+func jksPassword(password string) []byte {
+	var passwordBytes []byte
+	for _, char := range utf16.Encode([]rune(password)) {
+		passwordBytes = append(passwordBytes, byte(char>>8), byte(char))
+	}
+	return passwordBytes
+}
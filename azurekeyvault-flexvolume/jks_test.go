@@ -0,0 +1,243 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// testJKSEntry is an entry read from a JKS keystore
+type testJKSEntry struct {
+	tag       uint32
+	alias     string
+	timestamp int64
+	// the protected private key, empty for a trusted certificate
+	protectedKey []byte
+	certs        [][]byte
+}
+
+// readTestJKS reads a JKS keystore and checks its digest with password
+func readTestJKS(t *testing.T, content []byte, password string) []testJKSEntry {
+	if len(content) < sha1.Size {
+		t.Fatalf("keystore of %d bytes", len(content))
+	}
+	body, digest := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	// the digest is SHA-1 of the password in UTF-16 big endian, the whitener and the body
+	hash := sha1.New()
+	for _, char := range password {
+		hash.Write([]byte{byte(char >> 8), byte(char)})
+	}
+	hash.Write([]byte("Mighty Aphrodite"))
+	hash.Write(body)
+	if !bytes.Equal(hash.Sum(nil), digest) {
+		t.Fatalf("the digest of the keystore does not match the password")
+	}
+
+	r := bytes.NewReader(body)
+	read := func(value interface{}) {
+		if err := binary.Read(r, binary.BigEndian, value); err != nil {
+			t.Fatalf("truncated keystore: %s", err)
+		}
+	}
+	readBytes := func(length int) []byte {
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			t.Fatalf("truncated keystore: %s", err)
+		}
+		return value
+	}
+	readUTF := func() string {
+		var length uint16
+		read(&length)
+		return string(readBytes(int(length)))
+	}
+	readCert := func() []byte {
+		if certType := readUTF(); certType != "X.509" {
+			t.Fatalf("certificate type %q", certType)
+		}
+		var length uint32
+		read(&length)
+		return readBytes(int(length))
+	}
+
+	var magic, version, count uint32
+	read(&magic)
+	read(&version)
+	read(&count)
+	if magic != 0xfeedfeed || version != 2 {
+		t.Fatalf("magic %x version %d, want feedfeed version 2", magic, version)
+	}
+	var entries []testJKSEntry
+	for i := uint32(0); i < count; i++ {
+		var entry testJKSEntry
+		read(&entry.tag)
+		entry.alias = readUTF()
+		read(&entry.timestamp)
+		switch entry.tag {
+		case 1:
+			var length, chainLength uint32
+			read(&length)
+			entry.protectedKey = readBytes(int(length))
+			read(&chainLength)
+			for j := uint32(0); j < chainLength; j++ {
+				entry.certs = append(entry.certs, readCert())
+			}
+		case 2:
+			entry.certs = append(entry.certs, readCert())
+		default:
+			t.Fatalf("entry tag %d", entry.tag)
+		}
+		entries = append(entries, entry)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes after the entries", r.Len())
+	}
+	return entries
+}
+
+// recoverTestJKSKey decrypts a private key protected by the SUN key protector and returns its PKCS #8 encoding
+func recoverTestJKSKey(t *testing.T, protectedKey []byte, password string) []byte {
+	var info struct {
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}
+	if rest, err := asn1.Unmarshal(protectedKey, &info); err != nil || len(rest) != 0 {
+		t.Fatalf("invalid protected key: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}) {
+		t.Fatalf("key protector %s, want the SUN key protector", info.Algorithm.Algorithm)
+	}
+	protected := info.PrivateKey
+	if len(protected) < 2*sha1.Size {
+		t.Fatalf("protected key of %d bytes", len(protected))
+	}
+	passwordBytes := jksPassword(password)
+	salt, encrypted, check := protected[:sha1.Size], protected[sha1.Size:len(protected)-sha1.Size], protected[len(protected)-sha1.Size:]
+
+	var plainKey []byte
+	digest := salt
+	for offset := 0; offset < len(encrypted); offset += sha1.Size {
+		hash := sha1.New()
+		hash.Write(passwordBytes)
+		hash.Write(digest)
+		digest = hash.Sum(nil)
+		for i := 0; i < sha1.Size && offset+i < len(encrypted); i++ {
+			plainKey = append(plainKey, encrypted[offset+i]^digest[i])
+		}
+	}
+	hash := sha1.New()
+	hash.Write(passwordBytes)
+	hash.Write(plainKey)
+	if !bytes.Equal(hash.Sum(nil), check) {
+		t.Fatalf("the check of the protected key does not match the password")
+	}
+	return plainKey
+}
+
+func TestJKSPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		want     []byte
+	}{
+		{password: "", want: nil},
+		{password: "ab", want: []byte{0, 'a', 0, 'b'}},
+		{password: "é", want: []byte{0x00, 0xe9}},
+		// outside of the BMP, a surrogate pair
+		{password: "\U0001F511", want: []byte{0xd8, 0x3d, 0xdd, 0x11}},
+	}
+	for _, test := range tests {
+		if got := jksPassword(test.password); !bytes.Equal(got, test.want) {
+			t.Errorf("jksPassword(%q) = %x, want %x", test.password, got, test.want)
+		}
+	}
+}
+
+func TestEncodeJKS(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			key, chain := testChain(t, keyType)
+			now := time.Unix(1700000000, 123000000)
+			password := "changeit"
+
+			content, err := encodeJKS([]jksEntry{
+				{alias: "web", key: key, chain: chain},
+				{alias: "ca", chain: chain[1:]},
+			}, password, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries := readTestJKS(t, content, password)
+			if len(entries) != 2 {
+				t.Fatalf("%d entries, want 2", len(entries))
+			}
+
+			keyEntry, caEntry := entries[0], entries[1]
+			if keyEntry.tag != 1 || keyEntry.alias != "web" || keyEntry.timestamp != 1700000000123 {
+				t.Errorf("key entry %d %q %d", keyEntry.tag, keyEntry.alias, keyEntry.timestamp)
+			}
+			if len(keyEntry.certs) != 2 || !bytes.Equal(keyEntry.certs[0], chain[0].Raw) || !bytes.Equal(keyEntry.certs[1], chain[1].Raw) {
+				t.Errorf("the chain of the key entry is not the leaf followed by the CA")
+			}
+			wantKey, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plainKey := recoverTestJKSKey(t, keyEntry.protectedKey, password); !bytes.Equal(plainKey, wantKey) {
+				t.Errorf("the protected key does not decrypt to the PKCS #8 key")
+			}
+
+			if caEntry.tag != 2 || caEntry.alias != "ca" || len(caEntry.certs) != 1 || !bytes.Equal(caEntry.certs[0], chain[1].Raw) {
+				t.Errorf("trusted certificate entry %d %q with %d certificates", caEntry.tag, caEntry.alias, len(caEntry.certs))
+			}
+		})
+	}
+}
+
+func TestJKSProtectKeySalt(t *testing.T) {
+	key, _ := testChain(t, "ecdsa")
+	first, err := jksProtectKey(key, jksPassword("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := jksProtectKey(key, jksPassword("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Errorf("the key is protected twice with the same salt")
+	}
+}
+
+func TestKeystoreObjectsJKS(t *testing.T) {
+	key, chain := testChain(t, "rsa")
+	backend, cert := testCertificateBackend(t, key, chain)
+
+	objects, err := keystoreObjects(context.Background(), backend, Option{}, cert, FormatJKS, "web.jks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("%d objects, want the keystore and its password", len(objects))
+	}
+	password := string(objects[1].Content)
+	entries := readTestJKS(t, objects[0].Content, password)
+	if len(entries) != 1 || entries[0].alias != "web" {
+		t.Fatalf("entries %+v, want the key entry web", entries)
+	}
+	wantKey, _ := x509.MarshalPKCS8PrivateKey(key)
+	if plainKey := recoverTestJKSKey(t, entries[0].protectedKey, password); !bytes.Equal(plainKey, wantKey) {
+		t.Errorf("the protected key does not decrypt to the key of the secret")
+	}
+}
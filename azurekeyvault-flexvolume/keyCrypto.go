@@ -0,0 +1,224 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// algorithmRSNULL signs the value as is with PKCS #1 v1.5, the caller encodes the digest
+const algorithmRSNULL = "RSNULL"
+
+// Encryption algorithms of the Key Vault RSA keys
+const (
+	algorithmRSA15      = "RSA1_5"
+	algorithmRSAOAEP    = "RSA-OAEP"
+	algorithmRSAOAEP256 = "RSA-OAEP-256"
+)
+
+// signatureHash returns the hash of a Key Vault signature algorithm: RS, PS or ES with 256, 384 or 512
+func signatureHash(alg string) (crypto.Hash, error) {
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			return crypto.SHA256, nil
+		case "384":
+			return crypto.SHA384, nil
+		case "512":
+			return crypto.SHA512, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported signature algorithm %s", alg)
+}
+
+// signDigest signs a digest like Key Vault: PKCS #1 v1.5 or PSS for RSA keys, r||s for EC keys
+func signDigest(key crypto.Signer, alg string, digest []byte) ([]byte, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok && alg == algorithmRSNULL {
+		return rsa.SignPKCS1v15(rand.Reader, rsaKey, 0, digest)
+	}
+	hash, err := signatureHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("the digest of %s must be %d bytes", alg, hash.Size())
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PrivateKey:
+		if strings.HasPrefix(alg, "ES") {
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+			if err != nil {
+				return nil, err
+			}
+			size := (key.Curve.Params().BitSize + 7) / 8
+			return append(padBytes(r.Bytes(), size), padBytes(s.Bytes(), size)...), nil
+		}
+	}
+	return nil, fmt.Errorf("algorithm %s is not supported by %T keys", alg, key)
+}
+
+// verifyDigest checks a signature made by signDigest or by Key Vault
+func verifyDigest(key crypto.PublicKey, alg string, digest, signature []byte) error {
+	if rsaKey, ok := key.(*rsa.PublicKey); ok && alg == algorithmRSNULL {
+		return rsa.VerifyPKCS1v15(rsaKey, 0, digest, signature)
+	}
+	hash, err := signatureHash(alg)
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return fmt.Errorf("invalid signature size")
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return fmt.Errorf("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %s is not supported by %T keys", alg, key)
+}
+
+// encryptKey encrypts or wraps data with an RSA public key like Key Vault
+func encryptKey(key crypto.PublicKey, alg string, data []byte) ([]byte, error) {
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("algorithm %s is not supported by %T keys", alg, key)
+	}
+	switch alg {
+	case algorithmRSA15:
+		return rsa.EncryptPKCS1v15(rand.Reader, rsaKey, data)
+	case algorithmRSAOAEP:
+		return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, data, nil)
+	case algorithmRSAOAEP256:
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, data, nil)
+	}
+	return nil, fmt.Errorf("unsupported encryption algorithm %s", alg)
+}
+
+// decryptKey decrypts or unwraps data encrypted by encryptKey or by Key Vault
+func decryptKey(key crypto.Signer, alg string, data []byte) ([]byte, error) {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("algorithm %s is not supported by %T keys", alg, key)
+	}
+	switch alg {
+	case algorithmRSA15:
+		return rsa.DecryptPKCS1v15(rand.Reader, rsaKey, data)
+	case algorithmRSAOAEP:
+		return rsa.DecryptOAEP(sha1.New(), rand.Reader, rsaKey, data, nil)
+	case algorithmRSAOAEP256:
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, data, nil)
+	}
+	return nil, fmt.Errorf("unsupported encryption algorithm %s", alg)
+}
+
+// pemPrivateKey returns the first PEM encoded RSA or EC private key
+func pemPrivateKey(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	default:
+		return nil, fmt.Errorf("no private key")
+	}
+}
+
+// jsonWebKeyPublicKey decodes the public key of an RSA or EC JSON web key
+func jsonWebKeyPublicKey(jwk *JSONWebKey) (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(decoded), nil
+	}
+	switch strings.TrimSuffix(jwk.Kty, "-HSM") {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid modulus")
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x coordinate")
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y coordinate")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Keystore formats of the certificates, selected with -vaultObjectFormats and -truststoreFormat
+const (
+	FormatPKCS12 = "pkcs12"
+	FormatJKS    = "jks"
+)
+
+const (
+	// content type of the certificate secrets in PKCS #12
+	pkcs12ContentType = "application/x-pkcs12"
+	// suffix of the file with the generated password of a keystore
+	keystorePasswordSuffix = ".password"
+	keystorePasswordSize   = 24
+	// label of the derivation of the generated passwords
+	keystorePasswordLabel = "keystore password"
+)
+
+// keystoreObjects returns the keystore of a certificate, with the private key and the chain of its backing
+// secret, and the file of its password when it is generated
+func keystoreObjects(ctx context.Context, backend Backend, options Option, cert *ObjectBundle, format, fileName string) ([]KeyvaultObject, error) {
+	// Key Vault keeps the private key and the chain of a certificate in the secret of the same name and version
+	secret, err := backend.GetSecret(ctx, cert.Name, cert.Version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the secret of certificate %s", cert.Name)
+	}
+	key, chain, err := certificateKeyPair(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid secret of certificate %s", cert.Name)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode the private key of certificate %s", cert.Name)
+	}
+	password, generated, err := keystorePassword(ctx, backend, options, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	switch format {
+	case FormatPKCS12:
+		content, err = pkcs12.Modern.Encode(key, chain[0], chain[1:], password)
+	case FormatJKS:
+		content, err = encodeJKS([]jksEntry{{alias: strings.ToLower(cert.Name), key: key, chain: chain}}, password, time.Now())
+	default:
+		err = fmt.Errorf("unsupported keystore format %s", format)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode the keystore of certificate %s", cert.Name)
+	}
+
+	objects := []KeyvaultObject{{Type: VaultTypeCertificate, Name: cert.Name, Version: cert.Version, FileName: fileName, Content: content}}
+	if generated {
+		objects = append(objects, KeyvaultObject{Type: VaultTypeCertificate, Name: cert.Name, Version: cert.Version, FileName: fileName + keystorePasswordSuffix, Content: []byte(password)})
+	}
+	return objects, nil
+}
+
+// truststoreObjects returns the truststore of the CA certificates of -truststoreCerts, and the file of its
+// password when it is generated
+func truststoreObjects(ctx context.Context, backend Backend, options Option) ([]KeyvaultObject, error) {
+	var entries []jksEntry
+	var certs []*x509.Certificate
+	var raw []byte
+	for _, name := range strings.Split(options.truststoreCerts, objectsSep) {
+		bundle, err := resolveObject(ctx, backend, VaultTypeCertificate, name, "")
+		if err != nil {
+			return nil, sanitisedError(err, VaultTypeCertificate, name, "")
+		}
+		cert, err := x509.ParseCertificate(bundle.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid certificate %s", name)
+		}
+		certs = append(certs, cert)
+		raw = append(raw, cert.Raw...)
+		entries = append(entries, jksEntry{alias: strings.ToLower(name), chain: []*x509.Certificate{cert}})
+	}
+	// the password of a truststore only protects the integrity of certificates that are not secret
+	password, generated, err := keystorePassword(ctx, backend, options, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	switch options.truststoreFormat {
+	case FormatPKCS12:
+		content, err = pkcs12.Modern.EncodeTrustStore(certs, password)
+	case FormatJKS:
+		content, err = encodeJKS(entries, password, time.Now())
+	default:
+		err = fmt.Errorf("unsupported truststore format %s", options.truststoreFormat)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode the truststore")
+	}
+
+	objects := []KeyvaultObject{{Type: VaultTypeCertificate, Name: options.truststoreCerts, FileName: options.truststore, Content: content}}
+	if generated {
+		objects = append(objects, KeyvaultObject{Type: VaultTypeCertificate, Name: options.truststoreCerts, FileName: options.truststore + keystorePasswordSuffix, Content: []byte(password)})
+	}
+	return objects, nil
+}
+
+// keystorePassword returns the password of the keystores: the value of -keystorePasswordSecret, or a
+// password derived from seed to write next to the keystore when it is not set. The derived password is
+// the same on every poll of the same objects, so a rotation keeps it until the objects change.
+func keystorePassword(ctx context.Context, backend Backend, options Option, seed []byte) (password string, generated bool, err error) {
+	if options.keystorePasswordSecret != "" {
+		bundle, err := resolveObject(ctx, backend, VaultTypeSecret, options.keystorePasswordSecret, "")
+		if err != nil {
+			return "", false, sanitisedError(err, VaultTypeSecret, options.keystorePasswordSecret, "")
+		}
+		password := strings.TrimRight(string(bundle.Value), "\r\n")
+		if strings.TrimSpace(password) == "" {
+			return "", false, fmt.Errorf("secret %s of the keystore password is empty", options.keystorePasswordSecret)
+		}
+		return password, false, nil
+	}
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(keystorePasswordLabel))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:keystorePasswordSize]), true, nil
+}
+
+// certificateKeyPair returns the private key and the chain, leaf first, of the secret of a certificate:
+// a base64 encoded PKCS #12 archive without password, or PEM encoded key and certificates
+func certificateKeyPair(secret *ObjectBundle) (crypto.PrivateKey, []*x509.Certificate, error) {
+	var key crypto.PrivateKey
+	var certs []*x509.Certificate
+	if secret.ContentType == pkcs12ContentType {
+		pfx, err := base64.StdEncoding.DecodeString(string(secret.Value))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "invalid base64 PKCS #12 archive")
+		}
+		var leaf *x509.Certificate
+		key, leaf, certs, err = pkcs12.DecodeChain(pfx, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append([]*x509.Certificate{leaf}, certs...)
+	} else {
+		rest := secret.Value
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, err
+				}
+				certs = append(certs, cert)
+			case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+				signer, err := pemPrivateKey(pem.EncodeToMemory(block))
+				if err != nil {
+					return nil, nil, err
+				}
+				key = signer
+			}
+		}
+	}
+	if key == nil {
+		return nil, nil, fmt.Errorf("no private key, the certificate may not be exportable")
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no certificate")
+	}
+
+	// the leaf is the certificate of the private key, the rest of the chain keeps its order
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, cert := range certs {
+		if certPublicKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey); err == nil && bytes.Equal(certPublicKey, publicKey) {
+			chain := append([]*x509.Certificate{cert}, certs[:i]...)
+			return key, append(chain, certs[i+1:]...), nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no certificate matches the private key")
+}
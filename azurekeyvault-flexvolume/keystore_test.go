@@ -0,0 +1,212 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testChain returns a private key of keyType, its certificate and the CA certificate signing it
+func testChain(t *testing.T, keyType string) (crypto.Signer, []*x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key crypto.Signer
+	switch keyType {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "web"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, []*x509.Certificate{leaf, ca}
+}
+
+// testCertificateBackend returns a backend with the certificate web and its secret
+func testCertificateBackend(t *testing.T, key crypto.Signer, chain []*x509.Certificate) (*FileBackend, *ObjectBundle) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	for _, cert := range chain {
+		value = append(value, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	backend := &FileBackend{objects: map[string]map[string][]FileObject{}}
+	backend.add(VaultTypeSecret, FileObject{Name: "web", Version: "1", Value: string(value), ContentType: "application/x-pem-file"})
+	backend.add(VaultTypeSecret, FileObject{Name: "other", Version: "1", Value: "other"})
+	cert := &ObjectBundle{ObjectItem: ObjectItem{Type: VaultTypeCertificate, Name: "web", Version: "1"}, Value: chain[0].Raw}
+	return backend, cert
+}
+
+func TestKeystoreObjectsPKCS12(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ecdsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			key, chain := testChain(t, keyType)
+			backend, cert := testCertificateBackend(t, key, chain)
+			ctx := context.Background()
+
+			objects, err := keystoreObjects(ctx, backend, Option{}, cert, FormatPKCS12, "web.p12")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != 2 || objects[1].FileName != "web.p12"+keystorePasswordSuffix {
+				t.Fatalf("objects = %+v, want the keystore and its password", objects)
+			}
+			password := string(objects[1].Content)
+
+			decodedKey, leaf, cas, err := pkcs12.DecodeChain(objects[0].Content, password)
+			if err != nil {
+				t.Fatalf("failed to decode the keystore with its password: %s", err)
+			}
+			wantKey, _ := x509.MarshalPKCS8PrivateKey(key)
+			gotKey, _ := x509.MarshalPKCS8PrivateKey(decodedKey)
+			if !bytes.Equal(gotKey, wantKey) {
+				t.Errorf("the private key of the keystore differs from the one of the secret")
+			}
+			if !leaf.Equal(chain[0]) || len(cas) != 1 || !cas[0].Equal(chain[1]) {
+				t.Errorf("the keystore holds another chain")
+			}
+			if _, _, _, err := pkcs12.DecodeChain(objects[0].Content, password+"x"); err == nil {
+				t.Errorf("the keystore is decoded with a wrong password")
+			}
+
+			// the generated password is derived from the key, so it is the same on every poll
+			again, err := keystoreObjects(ctx, backend, Option{}, cert, FormatPKCS12, "web.p12")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again[1].Content) != password {
+				t.Errorf("the generated password changed between two polls")
+			}
+			otherKey, otherChain := testChain(t, keyType)
+			otherBackend, otherCert := testCertificateBackend(t, otherKey, otherChain)
+			other, err := keystoreObjects(ctx, otherBackend, Option{}, otherCert, FormatPKCS12, "web.p12")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(other[1].Content) == password {
+				t.Errorf("two keys have the same generated password")
+			}
+		})
+	}
+}
+
+func TestKeystoreObjectsPasswordSecret(t *testing.T) {
+	key, chain := testChain(t, "ecdsa")
+	backend, cert := testCertificateBackend(t, key, chain)
+	backend.add(VaultTypeSecret, FileObject{Name: "kspass", Version: "1", Value: "changeit\n"})
+
+	objects, err := keystoreObjects(context.Background(), backend, Option{keystorePasswordSecret: "kspass"}, cert, FormatPKCS12, "web.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Fatalf("%d objects, want the keystore without password file", len(objects))
+	}
+	if _, _, _, err := pkcs12.DecodeChain(objects[0].Content, "changeit"); err != nil {
+		t.Errorf("failed to decode the keystore with the password of the secret: %s", err)
+	}
+}
+
+func TestKeystoreObjectsBlankPasswordSecret(t *testing.T) {
+	key, chain := testChain(t, "ecdsa")
+	backend, cert := testCertificateBackend(t, key, chain)
+	for _, value := range []string{"", "\n", " \t\r\n"} {
+		backend.add(VaultTypeSecret, FileObject{Name: "kspass", Version: "1", Value: value})
+		if _, err := keystoreObjects(context.Background(), backend, Option{keystorePasswordSecret: "kspass"}, cert, FormatPKCS12, "web.p12"); err == nil {
+			t.Errorf("the keystore is written with the password %q", value)
+		}
+	}
+}
+
+func TestCertificateKeyPairPEMWithoutKey(t *testing.T) {
+	_, chain := testChain(t, "rsa")
+	var value []byte
+	for _, cert := range chain {
+		value = append(value, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	secret := &ObjectBundle{Value: value, ContentType: "application/x-pem-file"}
+	if _, _, err := certificateKeyPair(secret); err == nil || !strings.Contains(err.Error(), "no private key") {
+		t.Errorf("error = %v, want no private key", err)
+	}
+}
+
+func TestCertificateKeyPairPKCS12(t *testing.T) {
+	key, chain := testChain(t, "rsa")
+	// Key Vault returns the secret of a PKCS #12 certificate base64 encoded, without password
+	pfx, err := pkcs12.Modern.Encode(key, chain[0], chain[1:], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &ObjectBundle{Value: []byte(base64.StdEncoding.EncodeToString(pfx)), ContentType: pkcs12ContentType}
+
+	decodedKey, certs, err := certificateKeyPair(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKey, _ := x509.MarshalPKCS8PrivateKey(key)
+	gotKey, _ := x509.MarshalPKCS8PrivateKey(decodedKey)
+	if !bytes.Equal(gotKey, wantKey) {
+		t.Errorf("the private key differs from the one of the archive")
+	}
+	if len(certs) != 2 || !certs[0].Equal(chain[0]) || !certs[1].Equal(chain[1]) {
+		t.Errorf("the chain is not the leaf followed by the CA")
+	}
+}
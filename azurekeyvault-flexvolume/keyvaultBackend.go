@@ -0,0 +1,327 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/pkg/errors"
+)
+
+// KeyvaultBackend is the Backend of Azure Key Vault
+type KeyvaultBackend struct {
+	client   *kv.BaseClient
+	vaultURL string
+}
+
+func newKeyvaultBackend(ctx context.Context, options Option) (Backend, error) {
+	vaultURL, err := getVaultURL(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get vault")
+	}
+
+	client, err := initializeKvClient(options, *vaultURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get keyvaultClient")
+	}
+	return &KeyvaultBackend{client: client, vaultURL: *vaultURL}, nil
+}
+
+// GetSecret returns the value of a secret
+func (backend *KeyvaultBackend) GetSecret(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	secret, err := backend.client.GetSecret(ctx, backend.vaultURL, name, version)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &ObjectBundle{ObjectItem: secretItem(secret.ID, secret.Attributes, secret.Tags)}
+	if secret.Value != nil {
+		bundle.Value = []byte(*secret.Value)
+	}
+	if secret.ContentType != nil {
+		bundle.ContentType = *secret.ContentType
+	}
+	return bundle, nil
+}
+
+// GetKey returns the public part of a key
+func (backend *KeyvaultBackend) GetKey(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	key, err := backend.client.GetKey(ctx, backend.vaultURL, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if key.Key == nil {
+		return nil, errors.Errorf("key %s has no public key", name)
+	}
+	bundle := &ObjectBundle{ObjectItem: keyItem(key.Key.Kid, key.Attributes, key.Tags)}
+	bundle.Key = &JSONWebKey{
+		Kid: stringValue(key.Key.Kid),
+		Kty: string(key.Key.Kty),
+		N:   stringValue(key.Key.N),
+		E:   stringValue(key.Key.E),
+		Crv: string(key.Key.Crv),
+		X:   stringValue(key.Key.X),
+		Y:   stringValue(key.Key.Y),
+	}
+	return bundle, nil
+}
+
+// GetCertificate returns the DER encoded certificate
+func (backend *KeyvaultBackend) GetCertificate(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	cert, err := backend.client.GetCertificate(ctx, backend.vaultURL, name, version)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &ObjectBundle{ObjectItem: certificateItem(cert.ID, cert.Attributes, cert.Tags)}
+	if cert.Cer != nil {
+		bundle.Value = *cert.Cer
+	}
+	return bundle, nil
+}
+
+// WrapKey wraps a key with a key and returns the version of the key that wrapped it
+func (backend *KeyvaultBackend) WrapKey(ctx context.Context, name, version, alg string, plain []byte) (string, []byte, error) {
+	value := base64.RawURLEncoding.EncodeToString(plain)
+	result, err := backend.client.WrapKey(ctx, backend.vaultURL, name, version, kv.KeyOperationsParameters{Algorithm: kv.JSONWebKeyEncryptionAlgorithm(alg), Value: &value})
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(stringValue(result.Result), "="))
+	if err != nil {
+		return "", nil, err
+	}
+	if keyVersion := keyItem(result.Kid, nil, nil).Version; keyVersion != "" {
+		version = keyVersion
+	}
+	return version, wrapped, nil
+}
+
+// UnwrapKey unwraps a key with the private part of a key
+func (backend *KeyvaultBackend) UnwrapKey(ctx context.Context, name, version, alg string, wrapped []byte) ([]byte, error) {
+	value := base64.RawURLEncoding.EncodeToString(wrapped)
+	result, err := backend.client.UnwrapKey(ctx, backend.vaultURL, name, version, kv.KeyOperationsParameters{Algorithm: kv.JSONWebKeyEncryptionAlgorithm(alg), Value: &value})
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(stringValue(result.Result), "="))
+}
+
+// List returns the objects of a type
+func (backend *KeyvaultBackend) List(ctx context.Context, objectType string) ([]ObjectItem, error) {
+	return backend.list(ctx, objectType, "")
+}
+
+// Versions returns the versions of an object
+func (backend *KeyvaultBackend) Versions(ctx context.Context, objectType, name string) ([]ObjectItem, error) {
+	return backend.list(ctx, objectType, name)
+}
+
+// list returns the objects of a type, or the versions of the object name when it is set
+func (backend *KeyvaultBackend) list(ctx context.Context, objectType, name string) ([]ObjectItem, error) {
+	var items []ObjectItem
+	switch objectType {
+	case VaultTypeSecret:
+		var page kv.SecretListResultPage
+		var err error
+		if name == "" {
+			page, err = backend.client.GetSecrets(ctx, backend.vaultURL, nil)
+		} else {
+			page, err = backend.client.GetSecretVersions(ctx, backend.vaultURL, name, nil)
+		}
+		for ; err == nil && page.NotDone(); err = page.NextWithContext(ctx) {
+			for _, item := range page.Values() {
+				items = append(items, secretItem(item.ID, item.Attributes, item.Tags))
+			}
+		}
+		return items, err
+	case VaultTypeKey:
+		var page kv.KeyListResultPage
+		var err error
+		if name == "" {
+			page, err = backend.client.GetKeys(ctx, backend.vaultURL, nil)
+		} else {
+			page, err = backend.client.GetKeyVersions(ctx, backend.vaultURL, name, nil)
+		}
+		for ; err == nil && page.NotDone(); err = page.NextWithContext(ctx) {
+			for _, item := range page.Values() {
+				items = append(items, keyItem(item.Kid, item.Attributes, item.Tags))
+			}
+		}
+		return items, err
+	case VaultTypeCertificate:
+		var page kv.CertificateListResultPage
+		var err error
+		if name == "" {
+			page, err = backend.client.GetCertificates(ctx, backend.vaultURL, nil)
+		} else {
+			page, err = backend.client.GetCertificateVersions(ctx, backend.vaultURL, name, nil)
+		}
+		for ; err == nil && page.NotDone(); err = page.NextWithContext(ctx) {
+			for _, item := range page.Values() {
+				items = append(items, certificateItem(item.ID, item.Attributes, item.Tags))
+			}
+		}
+		return items, err
+	default:
+		return nil, errors.Errorf("Invalid vaultObjectTypes. Should be secret, key, or cert")
+	}
+}
+
+func secretItem(id *string, attributes *kv.SecretAttributes, tags map[string]*string) ObjectItem {
+	item := objectItem(VaultTypeSecret, id, tags)
+	if attributes != nil {
+		item.Enabled = attributes.Enabled
+		item.Created = unixTime(attributes.Created)
+		item.Updated = unixTime(attributes.Updated)
+		item.NotBefore = unixTime(attributes.NotBefore)
+		item.Expires = unixTime(attributes.Expires)
+	}
+	return item
+}
+
+func keyItem(kid *string, attributes *kv.KeyAttributes, tags map[string]*string) ObjectItem {
+	item := objectItem(VaultTypeKey, kid, tags)
+	if attributes != nil {
+		item.Enabled = attributes.Enabled
+		item.Created = unixTime(attributes.Created)
+		item.Updated = unixTime(attributes.Updated)
+		item.NotBefore = unixTime(attributes.NotBefore)
+		item.Expires = unixTime(attributes.Expires)
+	}
+	return item
+}
+
+func certificateItem(id *string, attributes *kv.CertificateAttributes, tags map[string]*string) ObjectItem {
+	item := objectItem(VaultTypeCertificate, id, tags)
+	if attributes != nil {
+		item.Enabled = attributes.Enabled
+		item.Created = unixTime(attributes.Created)
+		item.Updated = unixTime(attributes.Updated)
+		item.NotBefore = unixTime(attributes.NotBefore)
+		item.Expires = unixTime(attributes.Expires)
+	}
+	return item
+}
+
+// objectItem parses an object identifier such as https://<vault>/secrets/<name>[/<version>]
+func objectItem(objectType string, id *string, tags map[string]*string) ObjectItem {
+	item := ObjectItem{Type: objectType, Tags: map[string]string{}}
+	for key, value := range tags {
+		item.Tags[key] = stringValue(value)
+	}
+	if id == nil {
+		return item
+	}
+	u, err := url.Parse(*id)
+	if err != nil {
+		return item
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) > 1 {
+		item.Name = segments[1]
+	}
+	if len(segments) > 2 {
+		item.Version = segments[2]
+	}
+	return item
+}
+
+func unixTime(t *date.UnixTime) *time.Time {
+	if t == nil {
+		return nil
+	}
+	value := time.Time(*t)
+	return &value
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// initializeKvClient returns a client authenticated with the credentials of options
+func initializeKvClient(options Option, vaultURL string) (*kv.BaseClient, error) {
+	kvClient := kv.New()
+
+	env, err := ParseAzureEnvironment(options.cloudName, options.cloudEnvFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse Azure environment")
+	}
+
+	tenantID := options.tenantID
+	if strings.EqualFold(options.identitySystem, adfsIdentitySystem) {
+		tenantID = adfsIdentitySystem
+	}
+
+	// without a tenant, the authority and resource are discovered from the vault itself.
+	// An explicit vault URL keeps the resource of the cloud environment.
+	if tenantID == "" {
+		explicitURL := options.vaultURL != ""
+		challenge, err := discoverBearerChallenge(vaultURL, env, explicitURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to discover tenant from key vault")
+		}
+		env = challenge.applyTo(env, explicitURL)
+		tenantID = challenge.TenantID
+	}
+
+	credentials, err := CredentialChain(options.auth, options.usePodIdentity, options.useVmManagedIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := GetKeyvaultToken(AuthGrantType(), env, tenantID, credentials, options.msiEndpoint, options.vmManagedIdentityClientID, options.vmManagedIdentityResourceID, options.vmManagedIdentityObjectID, options.aADClientSecret, options.aADClientID, options.federatedTokenFile, options.federatedToken, options.podName, options.podNamespace, options.nmiPort)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get key vault token")
+	}
+
+	kvClient.Authorizer = token
+	kvClient.Sender = httpClient
+	return &kvClient, nil
+}
+
+// getVaultURL returns the URL of the vault, ending with a slash
+func getVaultURL(options Option) (vaultURL *string, err error) {
+	// an explicit URL (private endpoint, custom DNS or proxy) bypasses the name based construction;
+	// the token resource still comes from the cloud environment
+	if options.vaultURL != "" {
+		vaultUri := strings.TrimSuffix(options.vaultURL, "/") + "/"
+		return &vaultUri, nil
+	}
+
+	// See docs for validation spec: https://docs.microsoft.com/en-us/azure/key-vault/about-keys-secrets-and-certificates#objects-identifiers-and-versioning
+	if match, _ := regexp.MatchString("[-a-zA-Z0-9]{3,24}", options.vaultName); !match {
+		return nil, errors.Errorf("Invalid vault name: %q, must match [-a-zA-Z0-9]{3,24}", options.vaultName)
+	}
+	vaultDnsSuffix, err := GetVaultDNSSuffix(options.cloudName, options.cloudEnvFile)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultDnsSuffixValue := *vaultDnsSuffix
+
+	vaultUri := "https://" + options.vaultName + "." + vaultDnsSuffixValue + "/"
+	return &vaultUri, nil
+}
+
+// GetVaultDNSSuffix returns the DNS suffix of the vaults of the cloud
+func GetVaultDNSSuffix(cloudName, cloudEnvFile string) (vaultTld *string, err error) {
+	environment, err := ParseAzureEnvironment(cloudName, cloudEnvFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &environment.KeyVaultDNSSuffix, nil
+}
@@ -10,25 +10,37 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"regexp"
 	"strings"
+	"time"
 
-	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
-// KeyvaultFlexvolumeAdapter encapsulates the logic to connect to keyvault using provided identity,
+// KeyvaultFlexvolumeAdapter encapsulates the logic to connect to the provider using provided identity,
 // extract keys, secrets and certificate and write them on disk in the provided directory.
 type KeyvaultFlexvolumeAdapter struct {
 	ctx     context.Context
 	options Option
 }
 
-//Run fetches the specified objects from keyvault and writes them on dir
+// KeyvaultObject is an object fetched from keyvault with the content to write for it
+type KeyvaultObject struct {
+	// type of the object: secret, key, cert or encrypted-file
+	Type string
+	// name of the object in keyvault
+	Name string
+	// version of the object that was fetched
+	Version string
+	// path of the file relative to the volume, the alias when set
+	FileName string
+	// content of the file
+	Content []byte
+}
+
+// Run fetches the specified objects from keyvault and writes them on dir
 func (adapter *KeyvaultFlexvolumeAdapter) Run() error {
 	options := adapter.options
-	ctx := adapter.ctx
 	if options.showVersion {
 		glog.V(0).Infof("%s %s", program, version)
 		glog.V(2).Infof("%s", options.tenantID)
@@ -39,33 +51,67 @@ func (adapter *KeyvaultFlexvolumeAdapter) Run() error {
 		return errors.Wrapf(err, "failed to get directory %s", options.dir)
 	}
 
-	glog.Infof("starting the %s, %s", program, version)
-
-	vaultURL, err := adapter.getVaultURL()
+	objects, err := adapter.FetchObjects()
 	if err != nil {
-		return errors.Wrap(err, "failed to get vault")
+		return err
 	}
-	if vaultURL == nil {
-		return fmt.Errorf("vault url is nil")
+
+	// the files of a volume are listed for the wipe on unmount
+	if options.stateDir != "" {
+		var files []string
+		for _, object := range objects {
+			files = append(files, object.FileName)
+		}
+		if err := writeVolumeManifest(options.stateDir, options.dir, files); err != nil {
+			return err
+		}
+	}
+
+	for _, object := range objects {
+		fileName := path.Join(options.dir, object.FileName)
+		// the files of a layout are written in a directory of the volume
+		if err = os.MkdirAll(path.Dir(fileName), dirPermission); err != nil {
+			return errors.Wrapf(err, "failed to create the directory of %s", fileName)
+		}
+		if err = ioutil.WriteFile(fileName, object.Content, permission); err != nil {
+			return errors.Wrapf(err, "%s provider failed to write %s %s to %s", options.provider, object.Type, object.Name, fileName)
+		}
+		glog.V(0).Infof("%s provider wrote %s %s at %s", options.provider, object.Type, object.Name, fileName)
 	}
+	return nil
+}
+
+// FetchObjects retrieves the specified objects from the provider without writing them
+func (adapter *KeyvaultFlexvolumeAdapter) FetchObjects() ([]KeyvaultObject, error) {
+	options := adapter.options
+	ctx := adapter.ctx
 
-	kvClient, err := adapter.initializeKvClient()
+	glog.Infof("starting the %s, %s", program, version)
+
+	backend, err := newBackend(ctx, options)
 	if err != nil {
-		return errors.Wrap(err, "failed to get keyvaultClient")
+		return nil, errors.Wrapf(err, "failed to initialize the %s provider", options.provider)
 	}
 
 	objectTypes := strings.Split(options.vaultObjectTypes, objectsSep)
 	objectNames := strings.Split(options.vaultObjectNames, objectsSep)
 	objectAliases := strings.Split(options.vaultObjectAliases, objectsSep)
 	objectVersions := strings.Split(options.vaultObjectVersions, objectsSep)
+	objectVerifyWith := strings.Split(options.vaultObjectVerifyWith, objectsSep)
+	objectFormats := strings.Split(options.vaultObjectFormats, objectsSep)
+	objectLayouts := strings.Split(options.vaultObjectLayouts, objectsSep)
 
+	var objects []KeyvaultObject
 	for i := range objectNames {
 		objectType := objectTypes[i]
 		objectName := objectNames[i]
 		// default to the objectName and override if aliases are available
-		fileName := path.Join(options.dir, objectNames[i])
+		fileName := objectNames[i]
+		if objectType == VaultTypeEncryptedFile {
+			fileName = encryptedFileName(objectName)
+		}
 		if options.vaultObjectAliases != "" && len(objectAliases) == len(objectNames) {
-			fileName = path.Join(options.dir, objectAliases[i])
+			fileName = objectAliases[i]
 		}
 		// objectVersions are optional so we take as much as we can
 		objectVersion := ""
@@ -73,52 +119,53 @@ func (adapter *KeyvaultFlexvolumeAdapter) Run() error {
 			objectVersion = objectVersions[i]
 		}
 		glog.V(0).Infof("retrieving %s %s (version: %s)", objectType, objectName, objectVersion)
-		switch objectType {
-		case VaultTypeSecret:
-			secret, err := kvClient.GetSecret(ctx, *vaultURL, objectName, objectVersion)
-			if err != nil {
-				return sanitisedError(err, objectType, objectName, objectVersion)
-			}
-			if err = ioutil.WriteFile(fileName, []byte(*secret.Value), permission); err != nil {
-				return errors.Wrapf(err, "azure KeyVault failed to write secret %s to %s", objectName, fileName)
+		bundle, err := resolveObject(ctx, backend, objectType, objectName, objectVersion)
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		warning, err := checkExpiry(bundle, options.expiryPolicy, options.expiryWarningThreshold, time.Now())
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		if warning != "" {
+			glog.Warning(warning)
+		}
+		content, err := formatObject(bundle)
+		if err != nil {
+			return nil, sanitisedError(err, objectType, objectName, objectVersion)
+		}
+		if len(objectVerifyWith) == len(objectNames) && objectVerifyWith[i] != "" {
+			if err := verifyObject(ctx, backend, objectType, objectName, objectVerifyWith[i], content); err != nil {
+				return nil, sanitisedError(err, objectType, objectName, objectVersion)
 			}
-		case VaultTypeKey:
-			keybundle, err := kvClient.GetKey(ctx, *vaultURL, objectName, objectVersion)
+		}
+		if len(objectFormats) == len(objectNames) && objectFormats[i] != "" {
+			keystore, err := keystoreObjects(ctx, backend, options, bundle, objectFormats[i], fileName)
 			if err != nil {
-				return sanitisedError(err, objectType, objectName, objectVersion)
-			}
-			// NOTE: we are writing the RSA modulus content of the key
-			if err = ioutil.WriteFile(fileName, []byte(*keybundle.Key.N), permission); err != nil {
-				return errors.Wrapf(err, "azure KeyVault failed to write key %s to %s", objectName, fileName)
+				return nil, sanitisedError(err, objectType, objectName, objectVersion)
 			}
-		case VaultTypeCertificate:
-			certbundle, err := kvClient.GetCertificate(ctx, *vaultURL, objectName, objectVersion)
+			objects = append(objects, keystore...)
+			continue
+		}
+		if len(objectLayouts) == len(objectNames) && objectLayouts[i] == LayoutK8sTLS {
+			files, err := k8sTLSObjects(ctx, backend, bundle, fileName)
 			if err != nil {
-				return sanitisedError(err, objectType, objectName, objectVersion)
-			}
-			if err = ioutil.WriteFile(fileName, *certbundle.Cer, permission); err != nil {
-				return errors.Wrapf(err, "azure KeyVault failed to write certificate %s to %s", objectName, fileName)
+				return nil, sanitisedError(err, objectType, objectName, objectVersion)
 			}
-		default:
-			err = errors.Errorf("Invalid vaultObjectTypes. Should be secret, key, or cert")
-			return sanitisedError(err, objectType, objectName, objectVersion)
+			objects = append(objects, files...)
+			continue
 		}
-		glog.V(0).Infof("azure KeyVault wrote %s %s at %s", objectType, objectName, fileName)
+		object := KeyvaultObject{Type: objectType, Name: objectName, Version: bundle.Version, FileName: fileName, Content: content}
+		objects = append(objects, object)
 	}
-	return nil
-}
-
-func (adapter *KeyvaultFlexvolumeAdapter) initializeKvClient() (*kv.BaseClient, error) {
-	kvClient := kv.New()
-	options := adapter.options
-
-	token, err := GetKeyvaultToken(AuthGrantType(), options.cloudName, options.tenantID, options.usePodIdentity, options.useVmManagedIdentity, options.vmManagedIdentityClientID, options.aADClientSecret, options.aADClientID, options.podName, options.podNamespace, options.nmiPort)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get key vault token")
+	if options.truststore != "" {
+		truststore, err := truststoreObjects(ctx, backend, options)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, truststore...)
 	}
-
-	kvClient.Authorizer = token
-	return &kvClient, nil
+	return objects, nil
 }
 
 // azure-sdk-for-go returns some errors with \r\n in the body
@@ -127,29 +174,3 @@ func sanitisedError(err error, objectType string, objectName string, objectVersi
 	sanitisedErr := strings.Replace(err.Error(), "\\", " ", -1)
 	return fmt.Errorf("failed to get objectType:%s, objectName:%s, objectVersion:%s %s", objectType, objectName, objectVersion, sanitisedErr)
 }
-
-func (adapter *KeyvaultFlexvolumeAdapter) getVaultURL() (vaultURL *string, err error) {
-	// See docs for validation spec: https://docs.microsoft.com/en-us/azure/key-vault/about-keys-secrets-and-certificates#objects-identifiers-and-versioning
-	if match, _ := regexp.MatchString("[-a-zA-Z0-9]{3,24}", adapter.options.vaultName); !match {
-		return nil, errors.Errorf("Invalid vault name: %q, must match [-a-zA-Z0-9]{3,24}")
-	}
-	vaultDnsSuffix, err := GetVaultDNSSuffix(adapter.options.cloudName)
-	if err != nil {
-		return nil, err
-	}
-
-	vaultDnsSuffixValue := *vaultDnsSuffix
-
-	vaultUri := "https://" + adapter.options.vaultName + "." + vaultDnsSuffixValue + "/"
-	return &vaultUri, nil
-}
-
-func GetVaultDNSSuffix(cloudName string) (vaultTld *string, err error) {
-	environment, err := ParseAzureEnvironment(cloudName)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &environment.KeyVaultDNSSuffix, nil
-}
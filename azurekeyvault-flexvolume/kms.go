@@ -0,0 +1,185 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope/v1beta1"
+)
+
+const (
+	// the API server connects to the endpoint of the kms provider of its EncryptionConfiguration
+	kmsEndpoint   = "unix:///opt/azurekms.socket"
+	kmsConfigPath = "/etc/kubernetes/azure.json"
+	kmsAPIVersion = "v1beta1"
+)
+
+// KMSPlugin implements the Kubernetes KMS v1beta1 service. The data encryption keys of the
+// API server are wrapped and unwrapped by Key Vault with the key of the cloud config.
+type KMSPlugin struct {
+	agent *Agent
+	key   agentKey
+}
+
+// kmsCipher is the cipher returned to the API server, it keeps the version of the key that
+// wrapped the data encryption key so that it can still be unwrapped after the key is rotated
+type kmsCipher struct {
+	Version string `json:"version"`
+	Value   []byte `json:"value"`
+}
+
+// runKMS is the kms subcommand, it serves the KMS service until it is terminated
+func runKMS(args []string) int {
+	var endpoint, configPath string
+	var options Option
+	flag.StringVar(&endpoint, "endpoint", kmsEndpoint, "KMS plugin endpoint.")
+	flag.StringVar(&configPath, "config", kmsConfigPath, "Path to the cloud config with the credentials and the providerVaultName, providerKeyName and providerKeyVersion of the key.")
+	flag.StringVar(&options.vaultURL, "vaultURL", "", "URL of Azure Key Vault instance, e.g. a private endpoint or proxy. Overrides the URL built from providerVaultName.")
+	flag.StringVar(&options.cloudEnvFile, "cloudEnvFile", "", "Path to a JSON file describing a custom Azure cloud environment, e.g. Azure Stack Hub. Overrides the cloud of the config.")
+	flag.StringVar(&options.msiEndpoint, "msiEndpoint", "", "IMDS token endpoint, e.g. of an emulator. Empty to use the VM's IMDS.")
+	registerTransportFlags(flag.CommandLine, &options.transport)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+	defer glog.Flush()
+
+	if err := kmsOptions(configPath, &options); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	if err := configureHTTPClient(options.transport); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	// the agent checks the key can be read and authenticates again when its token is too old
+	agent, err := newAgent(context.Background(), options)
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	plugin := &KMSPlugin{agent: agent, key: agentKey{name: options.vaultObjectNames, version: options.vaultObjectVersions}}
+
+	listener, err := listenUnix(endpoint)
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	v1beta1.RegisterKeyManagementServiceServer(server, plugin)
+	stopOnSignal(server)
+
+	glog.Infof("starting the %s %s kms plugin with key %s (version: %s) on %s", program, version, plugin.key.name, plugin.key.version, endpoint)
+	if err := server.Serve(listener); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	return 0
+}
+
+// kmsOptions sets the vault, key and credentials of options from the cloud config at configPath
+func kmsOptions(configPath string, options *Option) error {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read the cloud config %s", configPath)
+	}
+	var config Config
+	if err := json.Unmarshal(content, &config); err != nil {
+		return errors.Wrapf(err, "failed to parse the cloud config %s", configPath)
+	}
+	if config.ProviderVaultName == "" && options.vaultURL == "" {
+		return fmt.Errorf("providerVaultName is not set in %s", configPath)
+	}
+	if config.ProviderKeyName == "" {
+		return fmt.Errorf("providerKeyName is not set in %s", configPath)
+	}
+	if config.AADClientCertPath != "" {
+		return fmt.Errorf("aadClientCertPath is not supported, use aadClientSecret or a managed identity")
+	}
+
+	options.provider = ProviderAzure
+	options.vaultName = config.ProviderVaultName
+	options.vaultObjectNames = config.ProviderKeyName
+	options.vaultObjectTypes = VaultTypeKey
+	options.vaultObjectVersions = config.ProviderKeyVersion
+	options.cloudName = config.Cloud
+	options.tenantID = config.TenantID
+	options.aADClientID = config.AADClientID
+	options.aADClientSecret = config.AADClientSecret
+	options.usePodIdentity = config.UsePodIdentity
+	options.useVmManagedIdentity = config.UseManagedIdentityExtension
+	options.vmManagedIdentityClientID = config.UserAssignedIdentityID
+	options.nmiPort = "2579"
+	return validateKeyvaultOptions(*options)
+}
+
+// Version returns the version of the KMS API and of the plugin
+func (plugin *KMSPlugin) Version(ctx context.Context, req *v1beta1.VersionRequest) (*v1beta1.VersionResponse, error) {
+	return &v1beta1.VersionResponse{Version: kmsAPIVersion, RuntimeName: program, RuntimeVersion: version}, nil
+}
+
+// Encrypt wraps a data encryption key with the key
+func (plugin *KMSPlugin) Encrypt(ctx context.Context, req *v1beta1.EncryptRequest) (*v1beta1.EncryptResponse, error) {
+	if err := checkKMSVersion(req.Version); err != nil {
+		return nil, err
+	}
+	backend, err := plugin.agent.backend()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	keyVersion, wrapped, err := backend.WrapKey(ctx, plugin.key.name, plugin.key.version, algorithmRSAOAEP256, req.Plain)
+	if err != nil {
+		return nil, status.Error(codes.Internal, sanitisedError(err, VaultTypeKey, plugin.key.name, plugin.key.version).Error())
+	}
+	cipher, err := json.Marshal(kmsCipher{Version: keyVersion, Value: wrapped})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &v1beta1.EncryptResponse{Cipher: cipher}, nil
+}
+
+// Decrypt unwraps a data encryption key with the version of the key that wrapped it
+func (plugin *KMSPlugin) Decrypt(ctx context.Context, req *v1beta1.DecryptRequest) (*v1beta1.DecryptResponse, error) {
+	if err := checkKMSVersion(req.Version); err != nil {
+		return nil, err
+	}
+	var cipher kmsCipher
+	if err := json.Unmarshal(req.Cipher, &cipher); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cipher: %s", err)
+	}
+	// an empty version would unwrap with the current version of the key
+	if cipher.Version == "" || len(cipher.Value) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid cipher: no key version or wrapped key")
+	}
+	backend, err := plugin.agent.backend()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	plain, err := backend.UnwrapKey(ctx, plugin.key.name, cipher.Version, algorithmRSAOAEP256, cipher.Value)
+	if err != nil {
+		return nil, status.Error(codes.Internal, sanitisedError(err, VaultTypeKey, plugin.key.name, cipher.Version).Error())
+	}
+	return &v1beta1.DecryptResponse{Plain: plain}, nil
+}
+
+// checkKMSVersion rejects the requests of another version of the KMS API
+func checkKMSVersion(requestVersion string) error {
+	if requestVersion != kmsAPIVersion {
+		return status.Errorf(codes.InvalidArgument, "unsupported KMS API version %q, only %s is supported", requestVersion, kmsAPIVersion)
+	}
+	return nil
+}
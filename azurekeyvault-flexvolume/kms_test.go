@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apiserver/pkg/storage/value/encrypt/envelope/v1beta1"
+)
+
+func TestKMSKeyRotation(t *testing.T) {
+	var keys []*rsa.PrivateKey
+	for i := 0; i < 2; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	emulator := startTestEmulator(t, FileFixture{Keys: []FileObject{{Name: "kek", Version: "1", PEM: testKeyPEM(t, keys[0])}}}, nil)
+	defer emulator.stop()
+	options := emulator.options()
+	options.vaultObjectNames = "kek"
+	options.vaultObjectTypes = VaultTypeKey
+	agent, err := newAgent(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &KMSPlugin{agent: agent, key: agentKey{name: "kek"}}
+	ctx := context.Background()
+
+	encrypt := func(plain []byte) []byte {
+		resp, err := plugin.Encrypt(ctx, &v1beta1.EncryptRequest{Version: kmsAPIVersion, Plain: plain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Cipher
+	}
+	cipherVersion := func(cipher []byte) string {
+		var decoded kmsCipher
+		if err := json.Unmarshal(cipher, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded.Version
+	}
+
+	before := encrypt([]byte("dek before the rotation"))
+	emulator.store.add(VaultTypeKey, FileObject{Name: "kek", Version: "2", PEM: testKeyPEM(t, keys[1])})
+	after := encrypt([]byte("dek after the rotation"))
+	if cipherVersion(before) != "1" || cipherVersion(after) != "2" {
+		t.Fatalf("cipher versions = %s, %s, want the version of the key that wrapped them", cipherVersion(before), cipherVersion(after))
+	}
+
+	for cipher, want := range map[string]string{string(before): "dek before the rotation", string(after): "dek after the rotation"} {
+		resp, err := plugin.Decrypt(ctx, &v1beta1.DecryptRequest{Version: kmsAPIVersion, Cipher: []byte(cipher)})
+		if err != nil {
+			t.Fatalf("failed to decrypt the cipher of version %s: %s", cipherVersion([]byte(cipher)), err)
+		}
+		if !bytes.Equal(resp.Plain, []byte(want)) {
+			t.Errorf("plain = %q, want %q", resp.Plain, want)
+		}
+	}
+
+	var wrapped kmsCipher
+	if err := json.Unmarshal(before, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	marshal := func(cipher kmsCipher) []byte {
+		content, err := json.Marshal(cipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	tampered := append([]byte{}, wrapped.Value...)
+	tampered[0] ^= 1
+	tests := []struct {
+		name    string
+		version string
+		cipher  []byte
+		want    codes.Code
+	}{
+		{name: "other API version", version: "v2", cipher: before, want: codes.InvalidArgument},
+		{name: "not JSON", version: kmsAPIVersion, cipher: []byte("k8s:enc:kms"), want: codes.InvalidArgument},
+		{name: "no key version", version: kmsAPIVersion, cipher: marshal(kmsCipher{Value: wrapped.Value}), want: codes.InvalidArgument},
+		{name: "no wrapped key", version: kmsAPIVersion, cipher: marshal(kmsCipher{Version: "1"}), want: codes.InvalidArgument},
+		{name: "another key version", version: kmsAPIVersion, cipher: marshal(kmsCipher{Version: "2", Value: wrapped.Value}), want: codes.Internal},
+		{name: "tampered wrapped key", version: kmsAPIVersion, cipher: marshal(kmsCipher{Version: "1", Value: tampered}), want: codes.Internal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := plugin.Decrypt(ctx, &v1beta1.DecryptRequest{Version: test.version, Cipher: test.cipher})
+			if status.Code(err) != test.want {
+				t.Errorf("error = %v, want the code %s", err, test.want)
+			}
+		})
+	}
+	if _, err := plugin.Encrypt(ctx, &v1beta1.EncryptRequest{Version: "v2", Plain: []byte("dek")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("error = %v, want the code %s for another API version", err, codes.InvalidArgument)
+	}
+}
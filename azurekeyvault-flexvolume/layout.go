@@ -0,0 +1,67 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// Layouts of the certificates, selected with -vaultObjectLayouts
+const (
+	// the files of a kubernetes.io/tls secret in a directory named by the alias
+	LayoutK8sTLS = "k8s-tls"
+)
+
+// files of the k8s-tls layout
+const (
+	tlsCertFileName = "tls.crt"
+	tlsKeyFileName  = "tls.key"
+	caCertFileName  = "ca.crt"
+)
+
+// k8sTLSObjects returns the files of the k8s-tls layout of a certificate in dir: the leaf and
+// its chain, the PKCS #8 private key of its backing secret, and its CA certificates when the
+// chain has any
+func k8sTLSObjects(ctx context.Context, backend Backend, cert *ObjectBundle, dir string) ([]KeyvaultObject, error) {
+	secret, err := backend.GetSecret(ctx, cert.Name, cert.Version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the secret of certificate %s", cert.Name)
+	}
+	key, chain, err := certificateKeyPair(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid secret of certificate %s", cert.Name)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode the private key of certificate %s", cert.Name)
+	}
+
+	newObject := func(fileName string, content []byte) KeyvaultObject {
+		return KeyvaultObject{Type: VaultTypeCertificate, Name: cert.Name, Version: cert.Version, FileName: path.Join(dir, fileName), Content: content}
+	}
+	objects := []KeyvaultObject{
+		newObject(tlsCertFileName, encodeCertificates(chain)),
+		newObject(tlsKeyFileName, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})),
+	}
+	if len(chain) > 1 {
+		objects = append(objects, newObject(caCertFileName, encodeCertificates(chain[1:])))
+	}
+	return objects, nil
+}
+
+// encodeCertificates returns the PEM encoded certificates, in order
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var content []byte
+	for _, cert := range certs {
+		content = append(content, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return content
+}
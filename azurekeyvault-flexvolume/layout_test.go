@@ -0,0 +1,58 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestK8sTLSObjects(t *testing.T) {
+	key, chain := testChain(t, "ecdsa")
+	wantKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		chain     []*x509.Certificate
+		wantFiles []string
+	}{
+		{name: "chain with a CA", chain: chain, wantFiles: []string{"web/tls.crt", "web/tls.key", "web/ca.crt"}},
+		{name: "chain without CA", chain: chain[:1], wantFiles: []string{"web/tls.crt", "web/tls.key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend, cert := testCertificateBackend(t, key, test.chain)
+			objects, err := k8sTLSObjects(context.Background(), backend, cert, "web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objects) != len(test.wantFiles) {
+				t.Fatalf("%d files, want %v", len(objects), test.wantFiles)
+			}
+			for i, object := range objects {
+				if object.FileName != test.wantFiles[i] {
+					t.Errorf("file %d = %s, want %s", i, object.FileName, test.wantFiles[i])
+				}
+			}
+			if !bytes.Equal(objects[0].Content, encodeCertificates(test.chain)) {
+				t.Errorf("tls.crt is not the leaf followed by its chain")
+			}
+			block, _ := pem.Decode(objects[1].Content)
+			if block == nil || block.Type != "PRIVATE KEY" || !bytes.Equal(block.Bytes, wantKey) {
+				t.Errorf("tls.key is not the PKCS #8 private key of the secret")
+			}
+			if len(objects) > 2 && !bytes.Equal(objects[2].Content, encodeCertificates(test.chain[1:])) {
+				t.Errorf("ca.crt is not the chain without the leaf")
+			}
+		})
+	}
+}
@@ -9,9 +9,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
-	"strings"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -21,6 +24,9 @@ const (
 	version                = "0.0.17"
 	permission os.FileMode = 0644
 	objectsSep             = ";"
+
+	// permission of the directories of the objects in the volume
+	dirPermission os.FileMode = 0755
 )
 
 // Type of Azure Key Vault objects
@@ -31,12 +37,18 @@ const (
 	VaultTypeKey string = "key"
 	// VaultTypeCertificate certificate vault object type
 	VaultTypeCertificate string = "cert"
+	// VaultTypeEncryptedFile local file encrypted with a vault key
+	VaultTypeEncryptedFile string = "encrypted-file"
 )
 
 // Option is a collection of configs
 type Option struct {
+	// the provider of the objects: azure, vault or file
+	provider string
 	// the name of the Azure Key Vault instance
 	vaultName string
+	// the URL of the Azure Key Vault instance, overrides the URL built from vaultName
+	vaultURL string
 	// the name of the Azure Key Vault objects
 	vaultObjectNames string
 	// the filenames the objects will be written to
@@ -45,20 +57,64 @@ type Option struct {
 	vaultObjectVersions string
 	// the types of the Azure Key Vault objects
 	vaultObjectTypes string
+	// the keys verifying the detached signatures of the objects, empty for the objects that are not signed
+	vaultObjectVerifyWith string
+	// the keystore formats of the certificates: pkcs12 or jks, empty to write them in PEM
+	vaultObjectFormats string
+	// the layouts of the certificates: k8s-tls, empty to write them as a single file
+	vaultObjectLayouts string
+	// the secret holding the password of the keystores, empty to generate it
+	keystorePasswordSecret string
+	// the filename of the truststore of truststoreCerts, empty for no truststore
+	truststore string
+	// the CA certificates of the truststore
+	truststoreCerts string
+	// the format of the truststore: pkcs12 or jks
+	truststoreFormat string
 	// directory to save the vault objects
 	dir string
+	// directory of the manifest of dir when it is a volume, set by the drivers and not by a flag
+	stateDir string
 	// version flag
 	showVersion bool
+	// check every object can be read, without writing to dir
+	dryRun bool
+	// the objects are only inspected by an admin command, set by the command and not by a flag
+	readOnly bool
+	// policy of the objects that are expired or not yet valid: refuse, warn or allow
+	expiryPolicy string
+	// how long before their expiry the objects are reported
+	expiryWarningThreshold time.Duration
+	// serve the key operations on a socket in dir instead of writing the keys
+	agent bool
+	// serve the keys as SSH identities on an ssh-agent socket in dir
+	sshAgent bool
 	// cloud name
 	cloudName string
+	// path to a JSON file describing a custom cloud environment
+	cloudEnvFile string
+	// identity system of the cloud: azure_ad or adfs
+	identitySystem string
 	// tenantID in AAD
 	tenantID string
 	// POD AAD Identity flag
 	usePodIdentity bool
 	// VM managed identity flag
 	useVmManagedIdentity bool
+	// ordered, comma separated credential sources to try: workload, pod, msi, sp
+	auth string
+	// path to the federated token (if using workload identity)
+	federatedTokenFile string
+	// the federated token of the pod, set by the CSI driver and not by a flag
+	federatedToken string
+	// the IMDS token endpoint, empty for the default one
+	msiEndpoint string
 	// the managed identity client ID
 	vmManagedIdentityClientID string
+	// the managed identity ARM resource ID
+	vmManagedIdentityResourceID string
+	// the managed identity object ID
+	vmManagedIdentityObjectID string
 	// AAD app client secret (if not using POD AAD Identity)
 	aADClientSecret string
 	// AAD app client secret id (if not using POD AAD Identity)
@@ -69,9 +125,56 @@ type Option struct {
 	podNamespace string
 	// the port NMI is running on (if using POD AAD Identity)
 	nmiPort string
+	// address of the HashiCorp Vault server (if using the vault provider)
+	vaultAddr string
+	// Vault token, skips the kubernetes login (if using the vault provider)
+	vaultToken string
+	// Vault role of the kubernetes login (if using the vault provider)
+	vaultRole string
+	// mount path of the kubernetes auth method (if using the vault provider)
+	vaultAuthPath string
+	// service account token of the kubernetes login (if using the vault provider)
+	vaultServiceAccountToken string
+	// path to the service account token, when vaultServiceAccountToken is not set
+	vaultServiceAccountTokenFile string
+	// mount path of the KV v2 secrets engine (if using the vault provider)
+	vaultKVPath string
+	// mount path of the PKI secrets engine (if using the vault provider)
+	vaultPKIPath string
+	// PKI role issuing the certificates (if using the vault provider)
+	vaultPKIRole string
+	// path to the directory tree or fixture file (if using the file provider)
+	filePath string
+	// settings of the HTTP transport used for every outbound call
+	transport TransportOptions
+}
+
+// subcommands of the binary; without one, the objects are fetched once using the flags
+var subcommands = map[string]func(args []string) int{
+	"csi":      runCSIDriver,
+	"provider": runProvider,
+	"emulator": runEmulator,
+	"list":     runList,
+	"versions": runVersions,
+	"get":      runGet,
+	"show":     runShow,
+	"encrypt":  runEncrypt,
+	"agent":    runAgent,
+	"kms":      runKMS,
 }
 
 func main() {
+	// the kubelet executes the driver with a FlexVolume call: init, mount or unmount
+	if isDriverCall(os.Args[1:]) {
+		os.Exit(runDriver(os.Args[1:]))
+	}
+
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
+
 	ctx := context.Background()
 	options, err := parseConfigs()
 	if err != nil {
@@ -79,7 +182,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := configureHTTPClient(options.transport); err != nil {
+		glog.Errorf("[error] : %s", err)
+		os.Exit(1)
+	}
+
+	if (options.agent || options.sshAgent) && !options.dryRun {
+		exitCode := serveAgent(ctx, *options, nil)
+		glog.Flush()
+		os.Exit(exitCode)
+	}
+
 	adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
+	if options.dryRun {
+		results, err := adapter.DryRun()
+		if err != nil {
+			glog.Errorf("[error] : %s", err)
+			glog.Flush()
+			os.Exit(dryRunExitFailure)
+		}
+		exitCode := printDryRun(os.Stdout, results)
+		glog.Flush()
+		os.Exit(exitCode)
+	}
+
 	err = adapter.Run()
 	if err != nil {
 		glog.Fatalf("[error] : %s", err)
@@ -90,48 +216,89 @@ func main() {
 
 func parseConfigs() (*Option, error) {
 	var options Option
-	flag.StringVar(&options.vaultName, "vaultName", "", "Name of Azure Key Vault instance.")
-	flag.StringVar(&options.vaultObjectNames, "vaultObjectNames", "", "Names of Azure Key Vault objects, semi-colon separated.")
-	flag.StringVar(&options.vaultObjectAliases, "vaultObjectAliases", "", "Filenames to write the Azure Key Vault objects to, semi-colon separated.")
-	flag.StringVar(&options.vaultObjectTypes, "vaultObjectTypes", "", "Types of Azure Key Vault objects, semi-colon separated.")
-	flag.StringVar(&options.vaultObjectVersions, "vaultObjectVersions", "", "Versions of Azure Key Vault objects, semi-colon separated.")
-	flag.StringVar(&options.aADClientID, "aADClientID", "", "aADClientID to Azure.")
-	flag.StringVar(&options.aADClientSecret, "aADClientSecret", "", "aADClientSecret to Azure.")
-	flag.StringVar(&options.cloudName, "cloudName", "", "Type of Azure cloud")
-	flag.StringVar(&options.tenantID, "tenantId", "", "tenantId to Azure")
-	flag.BoolVar(&options.usePodIdentity, "usePodIdentity", false, "usePodIdentity for using pod identity.")
-	flag.BoolVar(&options.useVmManagedIdentity, "useVmManagedIdentity", false, "Use the VM managed identity.")
-	flag.StringVar(&options.vmManagedIdentityClientID, "vmManagedIdentityClientID", "", "The VM managed identity client ID. Empty to use the System Assigned identity.")
-	flag.StringVar(&options.dir, "dir", "", "Directory path to write data.")
-	flag.BoolVar(&options.showVersion, "version", true, "Show version.")
-	flag.StringVar(&options.podName, "podName", "", "Name of the pod")
-	flag.StringVar(&options.podNamespace, "podNamespace", "", "Namespace of the pod")
-	flag.StringVar(&options.nmiPort, "nmiPort", "2579", "NMI port number")
-
+	registerFlags(flag.CommandLine, &options)
 	flag.Parse()
 
 	err := Validate(options)
 	return &options, err
 }
 
+// registerFlags registers the options on fs, with their defaults
+func registerFlags(fs *flag.FlagSet, options *Option) {
+	fs.StringVar(&options.provider, "provider", ProviderAzure, "Provider of the objects: "+strings.Join(backendNames(), ", ")+".")
+	fs.StringVar(&options.vaultName, "vaultName", "", "Name of Azure Key Vault instance.")
+	fs.StringVar(&options.vaultURL, "vaultURL", "", "URL of Azure Key Vault instance, e.g. a private endpoint or proxy. Overrides the URL built from -vaultName.")
+	fs.StringVar(&options.vaultObjectNames, "vaultObjectNames", "", "Names of Azure Key Vault objects, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectAliases, "vaultObjectAliases", "", "Filenames to write the Azure Key Vault objects to, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectTypes, "vaultObjectTypes", "", "Types of Azure Key Vault objects, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectVersions, "vaultObjectVersions", "", "Versions of Azure Key Vault objects, semi-colon separated.")
+	fs.StringVar(&options.vaultObjectVerifyWith, "vaultObjectVerifyWith", "", "Keys verifying the detached signature of the objects, as key or key:signature, semi-colon separated. Empty items are not verified.")
+	fs.StringVar(&options.vaultObjectFormats, "vaultObjectFormats", "", "Keystore formats of the certificates, pkcs12 or jks, semi-colon separated. Empty items are written in PEM.")
+	fs.StringVar(&options.vaultObjectLayouts, "vaultObjectLayouts", "", "Layouts of the certificates, k8s-tls to write tls.crt, tls.key and ca.crt in a directory named by the alias, semi-colon separated.")
+	fs.StringVar(&options.keystorePasswordSecret, "keystorePasswordSecret", "", "Secret holding the password of the keystores. Empty to generate it and write it to <keystore>.password.")
+	fs.StringVar(&options.truststore, "truststore", "", "Filename to write a truststore of -truststoreCerts to.")
+	fs.StringVar(&options.truststoreCerts, "truststoreCerts", "", "Names of the CA certificates of the truststore, semi-colon separated.")
+	fs.StringVar(&options.truststoreFormat, "truststoreFormat", FormatPKCS12, "Format of the truststore: pkcs12 or jks.")
+	fs.StringVar(&options.aADClientID, "aADClientID", "", "aADClientID to Azure.")
+	fs.StringVar(&options.aADClientSecret, "aADClientSecret", "", "aADClientSecret to Azure.")
+	fs.StringVar(&options.cloudName, "cloudName", "", "Type of Azure cloud")
+	fs.StringVar(&options.cloudEnvFile, "cloudEnvFile", "", "Path to a JSON file describing a custom Azure cloud environment, e.g. Azure Stack Hub. Overrides -cloudName.")
+	fs.StringVar(&options.identitySystem, "identitySystem", "azure_ad", "Identity system of the cloud: azure_ad or adfs.")
+	fs.StringVar(&options.tenantID, "tenantId", "", "tenantId to Azure. Empty to discover it from the key vault authentication challenge.")
+	fs.BoolVar(&options.usePodIdentity, "usePodIdentity", false, "usePodIdentity for using pod identity.")
+	fs.BoolVar(&options.useVmManagedIdentity, "useVmManagedIdentity", false, "Use the VM managed identity.")
+	fs.StringVar(&options.auth, "auth", "", "Ordered, comma separated credential sources to try: workload, pod, msi, sp. Empty to select a single source with -usePodIdentity and -useVmManagedIdentity.")
+	fs.StringVar(&options.federatedTokenFile, "federatedTokenFile", os.Getenv("AZURE_FEDERATED_TOKEN_FILE"), "Path to the federated service account token (if using workload identity).")
+	fs.StringVar(&options.msiEndpoint, "msiEndpoint", "", "IMDS token endpoint, e.g. of an emulator. Empty to use the VM's IMDS.")
+	fs.StringVar(&options.vmManagedIdentityClientID, "vmManagedIdentityClientID", "", "The VM managed identity client ID. Empty to use the System Assigned identity.")
+	fs.StringVar(&options.vmManagedIdentityResourceID, "vmManagedIdentityResourceID", "", "The VM managed identity ARM resource ID. Empty to use the System Assigned identity.")
+	fs.StringVar(&options.vmManagedIdentityObjectID, "vmManagedIdentityObjectID", "", "The VM managed identity object ID. Empty to use the System Assigned identity.")
+	fs.StringVar(&options.dir, "dir", "", "Directory path to write data.")
+	fs.BoolVar(&options.showVersion, "version", true, "Show version.")
+	fs.BoolVar(&options.dryRun, "dryRun", false, "Check every object can be read and print their status, without writing to -dir. Exits with 2 when an object cannot be read.")
+	fs.StringVar(&options.expiryPolicy, "expiryPolicy", ExpiryPolicyWarn, "Policy of the objects that are expired or not yet valid: refuse, warn or allow.")
+	fs.DurationVar(&options.expiryWarningThreshold, "expiryWarningThreshold", defaultExpiryWarningThreshold, "How long before their expiry the objects are reported, e.g. 336h for 14 days.")
+	fs.BoolVar(&options.agent, "agent", false, "Serve the key operations of the keys on a unix socket in -dir instead of writing them (if using the azure provider).")
+	fs.BoolVar(&options.sshAgent, "sshAgent", false, "Serve the keys as SSH identities on an ssh-agent socket in -dir instead of writing them (if using the azure provider).")
+	fs.StringVar(&options.podName, "podName", "", "Name of the pod")
+	fs.StringVar(&options.podNamespace, "podNamespace", "", "Namespace of the pod")
+	fs.StringVar(&options.nmiPort, "nmiPort", "2579", "NMI port number")
+	fs.StringVar(&options.vaultAddr, "vaultAddr", os.Getenv("VAULT_ADDR"), "Address of the HashiCorp Vault server (if using the vault provider).")
+	fs.StringVar(&options.vaultToken, "vaultToken", os.Getenv("VAULT_TOKEN"), "Vault token. Empty to log in with the kubernetes auth method.")
+	fs.StringVar(&options.vaultRole, "vaultRole", "", "Vault role of the kubernetes auth method.")
+	fs.StringVar(&options.vaultAuthPath, "vaultAuthPath", "kubernetes", "Mount path of the Vault kubernetes auth method.")
+	fs.StringVar(&options.vaultServiceAccountToken, "vaultServiceAccountToken", "", "Service account token of the Vault kubernetes login. Empty to read -vaultServiceAccountTokenFile.")
+	fs.StringVar(&options.vaultServiceAccountTokenFile, "vaultServiceAccountTokenFile", "/var/run/secrets/kubernetes.io/serviceaccount/token", "Path to the service account token of the Vault kubernetes login.")
+	fs.StringVar(&options.vaultKVPath, "vaultKVPath", "secret", "Mount path of the Vault KV v2 secrets engine.")
+	fs.StringVar(&options.vaultPKIPath, "vaultPKIPath", "pki", "Mount path of the Vault PKI secrets engine.")
+	fs.StringVar(&options.vaultPKIRole, "vaultPKIRole", "", "Vault PKI role issuing the certificates.")
+	fs.StringVar(&options.filePath, "filePath", "", "Path to a directory tree or a JSON/YAML fixture file (if using the file provider).")
+
+	registerTransportFlags(fs, &options.transport)
+}
+
+// registerTransportFlags registers the settings of the shared HTTP transport on fs
+func registerTransportFlags(fs *flag.FlagSet, transport *TransportOptions) {
+	fs.DurationVar(&transport.Timeout, "httpTimeout", 60*time.Second, "Overall timeout of outbound HTTP requests.")
+	fs.DurationVar(&transport.DialTimeout, "httpDialTimeout", 10*time.Second, "Timeout to establish outbound connections.")
+	fs.DurationVar(&transport.TLSHandshakeTimeout, "httpTLSHandshakeTimeout", 10*time.Second, "Timeout of the TLS handshake of outbound connections.")
+	fs.DurationVar(&transport.KeepAlive, "httpKeepAlive", 30*time.Second, "TCP keep-alive period of outbound connections.")
+	fs.DurationVar(&transport.IdleConnTimeout, "httpIdleConnTimeout", 90*time.Second, "How long idle outbound connections are kept for reuse.")
+	fs.StringVar(&transport.CABundle, "caBundle", "", "Path to a PEM bundle of CA certificates to trust in addition to the system roots.")
+	fs.StringVar(&transport.HTTPSProxy, "httpsProxy", "", "Proxy for outbound https requests. Defaults to HTTPS_PROXY.")
+	fs.StringVar(&transport.NoProxy, "noProxy", "", "Hosts excluded from proxying. Defaults to NO_PROXY.")
+}
+
 // Validate volume options
 func Validate(options Option) error {
-	if options.vaultName == "" {
-		return fmt.Errorf("-vaultName is not set")
-	}
-
 	if options.vaultObjectNames == "" {
 		return fmt.Errorf("-vaultObjectNames is not set")
 	}
 
-	if options.dir == "" {
+	if options.dir == "" && !options.dryRun {
 		return fmt.Errorf("-dir is not set")
 	}
 
-	if options.tenantID == "" {
-		return fmt.Errorf("-tenantId is not set")
-	}
-
 	if strings.Count(options.vaultObjectNames, objectsSep) !=
 		strings.Count(options.vaultObjectTypes, objectsSep) {
 		return fmt.Errorf("-vaultObjectNames and -vaultObjectTypes do not have the same number of items")
@@ -142,37 +309,253 @@ func Validate(options Option) error {
 		return fmt.Errorf("-vaultObjectNames and -vaultObjectAliases do not have the same number of items")
 	}
 
-	if !options.usePodIdentity && !options.useVmManagedIdentity {
-		if options.aADClientID == "" {
-			return fmt.Errorf("-aADClientID is not set")
+	if err := validateAliases(options); err != nil {
+		return err
+	}
+
+	if len(options.vaultObjectVerifyWith) > 0 &&
+		(strings.Count(options.vaultObjectNames, objectsSep) != strings.Count(options.vaultObjectVerifyWith, objectsSep)) {
+		return fmt.Errorf("-vaultObjectNames and -vaultObjectVerifyWith do not have the same number of items")
+	}
+
+	if len(options.vaultObjectFormats) > 0 &&
+		(strings.Count(options.vaultObjectNames, objectsSep) != strings.Count(options.vaultObjectFormats, objectsSep)) {
+		return fmt.Errorf("-vaultObjectNames and -vaultObjectFormats do not have the same number of items")
+	}
+
+	if len(options.vaultObjectLayouts) > 0 &&
+		(strings.Count(options.vaultObjectNames, objectsSep) != strings.Count(options.vaultObjectLayouts, objectsSep)) {
+		return fmt.Errorf("-vaultObjectNames and -vaultObjectLayouts do not have the same number of items")
+	}
+
+	if err := validateProviderOptions(options); err != nil {
+		return err
+	}
+
+	if err := validateKeystoreOptions(options); err != nil {
+		return err
+	}
+
+	if options.expiryPolicy != ExpiryPolicyRefuse && options.expiryPolicy != ExpiryPolicyWarn && options.expiryPolicy != ExpiryPolicyAllow {
+		return fmt.Errorf("-expiryPolicy is invalid, should be set to refuse, warn or allow")
+	}
+	if options.expiryWarningThreshold < 0 {
+		return fmt.Errorf("-expiryWarningThreshold must not be negative")
+	}
+
+	// validate all object types
+	for _, objectType := range strings.Split(options.vaultObjectTypes, objectsSep) {
+		if objectType != VaultTypeSecret && objectType != VaultTypeKey && objectType != VaultTypeCertificate && objectType != VaultTypeEncryptedFile {
+			return fmt.Errorf("-vaultObjectType is invalid, should be set to secret, key, certificate, or encrypted-file")
+		}
+		if (options.agent || options.sshAgent) && objectType != VaultTypeKey {
+			return fmt.Errorf("-agent and -sshAgent only serve keys, -vaultObjectTypes should only contain key")
+		}
+	}
+
+	if (options.agent || options.sshAgent) && options.provider != ProviderAzure {
+		return fmt.Errorf("-agent and -sshAgent are only supported by the azure provider")
+	}
+
+	return nil
+}
+
+// validateAliases checks the aliases are relative paths that stay inside -dir
+func validateAliases(options Option) error {
+	if options.vaultObjectAliases == "" {
+		return nil
+	}
+	for _, alias := range strings.Split(options.vaultObjectAliases, objectsSep) {
+		if path.IsAbs(alias) {
+			return fmt.Errorf("-vaultObjectAliases is invalid, %s is an absolute path", alias)
+		}
+		for _, element := range strings.Split(alias, "/") {
+			if element == ".." {
+				return fmt.Errorf("-vaultObjectAliases is invalid, %s contains ..", alias)
+			}
+		}
+		if cleaned := path.Clean(alias); cleaned == "." || strings.HasPrefix(cleaned, "../") {
+			return fmt.Errorf("-vaultObjectAliases is invalid, %s is not a file of -dir", alias)
+		}
+	}
+	return nil
+}
+
+// validateKeystoreOptions checks the keystore formats and layouts of the certificates and the truststore
+func validateKeystoreOptions(options Option) error {
+	if options.vaultObjectFormats != "" {
+		objectTypes := strings.Split(options.vaultObjectTypes, objectsSep)
+		for i, format := range strings.Split(options.vaultObjectFormats, objectsSep) {
+			if format == "" {
+				continue
+			}
+			if objectTypes[i] != VaultTypeCertificate || (format != FormatPKCS12 && format != FormatJKS) {
+				return fmt.Errorf("-vaultObjectFormats is invalid, should be set to pkcs12 or jks for cert objects")
+			}
 		}
-		if options.aADClientSecret == "" {
-			return fmt.Errorf("-aADClientSecret is not set")
+	}
+	if options.vaultObjectLayouts != "" {
+		objectTypes := strings.Split(options.vaultObjectTypes, objectsSep)
+		objectFormats := strings.Split(options.vaultObjectFormats, objectsSep)
+		for i, layout := range strings.Split(options.vaultObjectLayouts, objectsSep) {
+			if layout == "" {
+				continue
+			}
+			if objectTypes[i] != VaultTypeCertificate || layout != LayoutK8sTLS {
+				return fmt.Errorf("-vaultObjectLayouts is invalid, should be set to k8s-tls for cert objects")
+			}
+			if options.vaultObjectFormats != "" && objectFormats[i] != "" {
+				return fmt.Errorf("-vaultObjectLayouts and -vaultObjectFormats cannot both be set for the same object")
+			}
 		}
 	}
+	if options.truststore != "" && options.truststoreCerts == "" {
+		return fmt.Errorf("-truststoreCerts is not set")
+	}
+	if options.truststoreFormat != FormatPKCS12 && options.truststoreFormat != FormatJKS {
+		return fmt.Errorf("-truststoreFormat is invalid, should be set to pkcs12 or jks")
+	}
+	return nil
+}
+
+// validateProviderOptions checks the provider and its connection and credential options
+func validateProviderOptions(options Option) error {
+	if _, ok := backends[options.provider]; !ok {
+		return fmt.Errorf("-provider is invalid, should be set to %s", strings.Join(backendNames(), ", "))
+	}
 
-	if options.usePodIdentity {
-		if options.podName == "" {
-			return fmt.Errorf("-podName is not set")
+	if options.identitySystem != "" && !strings.EqualFold(options.identitySystem, adfsIdentitySystem) && !strings.EqualFold(options.identitySystem, azureADIdentitySystem) {
+		return fmt.Errorf("-identitySystem is invalid, should be set to azure_ad or adfs")
+	}
+
+	switch options.provider {
+	case ProviderAzure:
+		if err := validateKeyvaultOptions(options); err != nil {
+			return err
+		}
+	case ProviderVault:
+		if err := validateVaultOptions(options); err != nil {
+			return err
+		}
+	case ProviderFile:
+		if options.filePath == "" {
+			return fmt.Errorf("-filePath is not set")
 		}
-		if options.podNamespace == "" {
-			return fmt.Errorf("-podNamespace is not set")
+	}
+
+	return nil
+}
+
+// validateKeyvaultOptions checks the vault and credential options of the azure provider
+func validateKeyvaultOptions(options Option) error {
+	if options.vaultName == "" && options.vaultURL == "" {
+		return fmt.Errorf("-vaultName is not set")
+	}
+
+	if options.vaultURL != "" {
+		if err := validateVaultURL(options.vaultURL); err != nil {
+			return err
 		}
-		if options.nmiPort == "" {
-			return fmt.Errorf("-nmiPort is not set")
+	}
+
+	credentials, err := CredentialChain(options.auth, options.usePodIdentity, options.useVmManagedIdentity)
+	if err != nil {
+		return fmt.Errorf("-auth is invalid: %s", err)
+	}
+
+	// a single credential source must be fully configured, sources of a longer chain
+	// that are missing settings are skipped when the token is retrieved
+	strict := len(credentials) == 1
+	for _, credential := range credentials {
+		switch credential {
+		case CredentialServicePrincipal:
+			if strict && options.aADClientID == "" {
+				return fmt.Errorf("-aADClientID is not set")
+			}
+			if strict && options.aADClientSecret == "" {
+				return fmt.Errorf("-aADClientSecret is not set")
+			}
+		case CredentialWorkloadIdentity:
+			if strict && options.aADClientID == "" {
+				return fmt.Errorf("-aADClientID is not set")
+			}
+			if strict && options.federatedTokenFile == "" && options.federatedToken == "" {
+				return fmt.Errorf("-federatedTokenFile is not set")
+			}
+		case CredentialPodIdentity:
+			if strict && options.podName == "" {
+				return fmt.Errorf("-podName is not set")
+			}
+			if strict && options.podNamespace == "" {
+				return fmt.Errorf("-podNamespace is not set")
+			}
+			if options.nmiPort == "" {
+				return fmt.Errorf("-nmiPort is not set")
+			}
+			if _, err := strconv.ParseUint(options.nmiPort, 10, 16); err != nil {
+				return fmt.Errorf("-nmiPort must be an integer between 0 and 65535")
+			}
 		}
-		if _, err := strconv.ParseUint(options.nmiPort, 10, 16); err != nil {
-			return fmt.Errorf("-nmiPort must be an integer between 0 and 65535")
+	}
+
+	// a user assigned identity can be selected by exactly one of its identifiers
+	identitySelectors := 0
+	for _, selector := range []string{options.vmManagedIdentityClientID, options.vmManagedIdentityResourceID, options.vmManagedIdentityObjectID} {
+		if selector != "" {
+			identitySelectors++
 		}
 	}
+	if identitySelectors > 1 {
+		return fmt.Errorf("only one of -vmManagedIdentityClientID, -vmManagedIdentityResourceID or -vmManagedIdentityObjectID can be set")
+	}
 
-	// validate all object types
+	return nil
+}
+
+// validateVaultOptions checks the server and login options of the vault provider
+func validateVaultOptions(options Option) error {
+	if options.vaultAddr == "" {
+		return fmt.Errorf("-vaultAddr is not set")
+	}
+	u, err := url.Parse(options.vaultAddr)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("-vaultAddr is invalid, should be an http(s) URL")
+	}
+	if options.vaultToken == "" && options.vaultRole == "" {
+		return fmt.Errorf("-vaultRole is not set")
+	}
+	if options.vaultObjectVerifyWith != "" {
+		return fmt.Errorf("-vaultObjectVerifyWith is not supported by the vault provider, it has no keys")
+	}
+	if options.truststore != "" {
+		return fmt.Errorf("-truststore is not supported by the vault provider, its certificates are issued on every mount")
+	}
 	for _, objectType := range strings.Split(options.vaultObjectTypes, objectsSep) {
-		if objectType != VaultTypeSecret && objectType != VaultTypeKey && objectType != VaultTypeCertificate {
-			return fmt.Errorf("-vaultObjectType is invalid, should be set to secret, key, or certificate")
+		if objectType == VaultTypeKey || objectType == VaultTypeEncryptedFile {
+			return fmt.Errorf("-vaultObjectTypes is invalid, keys and encrypted files are not supported by the vault provider")
+		}
+		if objectType == VaultTypeCertificate && options.vaultPKIRole == "" {
+			return fmt.Errorf("-vaultPKIRole is not set")
 		}
 	}
+	return nil
+}
 
+// validateVaultURL checks that vaultURL is an absolute https URL pointing at the root of a vault
+func validateVaultURL(vaultURL string) error {
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return fmt.Errorf("-vaultURL is invalid: %s", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("-vaultURL is invalid, scheme must be https")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("-vaultURL is invalid, host is not set")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("-vaultURL is invalid, must not contain user info, query or fragment")
+	}
 	return nil
 }
 
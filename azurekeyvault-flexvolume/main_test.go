@@ -0,0 +1,47 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateAliases(t *testing.T) {
+	tests := []struct {
+		aliases string
+		valid   bool
+	}{
+		{aliases: "db-password;tls.crt", valid: true},
+		{aliases: "secrets/db-password;tls/web", valid: true},
+		{aliases: "./db-password;tls.crt", valid: true},
+		{aliases: "db..password;tls.crt", valid: true},
+		{aliases: "/etc/shadow;tls.crt"},
+		{aliases: "db-password;../../etc/shadow"},
+		{aliases: "secrets/../../shadow;tls.crt"},
+		{aliases: "secrets/..;tls.crt"},
+		{aliases: ".;tls.crt"},
+		{aliases: ";tls.crt"},
+	}
+	for _, test := range tests {
+		options := Option{
+			provider:         ProviderFile,
+			filePath:         "/etc/kv-dev",
+			dir:              "/kvmnt",
+			vaultObjectNames: "db-password;web",
+			vaultObjectTypes: "secret;cert",
+			expiryPolicy:     ExpiryPolicyWarn,
+			truststoreFormat: FormatPKCS12,
+		}
+		options.vaultObjectAliases = test.aliases
+		err := Validate(options)
+		if test.valid && err != nil {
+			t.Errorf("Validate(%q): %s", test.aliases, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Validate(%q) accepts aliases outside of -dir", test.aliases)
+		}
+	}
+}
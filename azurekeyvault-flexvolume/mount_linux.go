@@ -0,0 +1,77 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+func mountTmpfs(dir string) error {
+	return syscall.Mount("tmpfs", dir, "tmpfs", 0, "")
+}
+
+func unmountTmpfs(dir string) error {
+	return syscall.Unmount(dir, 0)
+}
+
+// detachedProcess runs a process in its own session, it outlives the driver call that started it
+func detachedProcess() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// isMounted returns true when dir is a mount point
+func isMounted(dir string) (bool, error) {
+	dir = filepath.Clean(dir)
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open %s", mountInfoPath)
+	}
+	defer file.Close()
+
+	// see https://www.kernel.org/doc/Documentation/filesystems/proc.txt, the mount point is the 5th field
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		if unescapeMountPath(fields[4]) == dir {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space) of mountinfo paths
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
@@ -0,0 +1,34 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"testing"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/var/lib/kubelet/pods/uid/volumes/kv", want: "/var/lib/kubelet/pods/uid/volumes/kv"},
+		{path: `/mnt/my\040volume`, want: "/mnt/my volume"},
+		{path: `/mnt/tab\011and\012newline`, want: "/mnt/tab\tand\nnewline"},
+		{path: `/mnt/back\134slash`, want: `/mnt/back\slash`},
+		{path: `/mnt/end\040`, want: "/mnt/end "},
+		{path: `/mnt/short\04`, want: `/mnt/short\04`},
+		{path: `/mnt/not\08octal`, want: `/mnt/not\08octal`},
+		{path: `/mnt/overflow\777`, want: `/mnt/overflow\777`},
+	}
+	for _, test := range tests {
+		if got := unescapeMountPath(test.path); got != test.want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
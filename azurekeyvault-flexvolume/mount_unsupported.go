@@ -0,0 +1,31 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+func mountTmpfs(dir string) error {
+	return fmt.Errorf("tmpfs mounts are not supported on %s", runtime.GOOS)
+}
+
+func unmountTmpfs(dir string) error {
+	return fmt.Errorf("tmpfs mounts are not supported on %s", runtime.GOOS)
+}
+
+func detachedProcess() *syscall.SysProcAttr {
+	return nil
+}
+
+func isMounted(dir string) (bool, error) {
+	return false, fmt.Errorf("mount points are not supported on %s", runtime.GOOS)
+}
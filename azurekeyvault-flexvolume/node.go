@@ -0,0 +1,78 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultStateDir is the directory of the state of the driver on the node
+const defaultStateDir = "/var/lib/kv-driver"
+
+// NodeOptions are the settings of the node. They point the driver at files and endpoints of the
+// node, so they are flags of the driver and never options of a volume.
+type NodeOptions struct {
+	// path to a JSON file describing a custom cloud environment
+	CloudEnvFile string
+	// the IMDS token endpoint, empty for the default one
+	MSIEndpoint string
+	// directory of the trees and fixtures of the file provider, empty to disable it for the volumes
+	FileRoot string
+	// directory of the state of the driver, e.g. the manifests of the volumes, never writable by the pods
+	StateDir string
+	// settings of the HTTP transport used for every outbound call
+	Transport TransportOptions
+}
+
+// registerNodeFlags registers the settings of the node on fs
+func registerNodeFlags(fs *flag.FlagSet, node *NodeOptions) {
+	fs.StringVar(&node.CloudEnvFile, "cloudEnvFile", "", "Path to a JSON file describing a custom Azure cloud environment, e.g. Azure Stack Hub. Overrides the cloud of the volumes.")
+	fs.StringVar(&node.MSIEndpoint, "msiEndpoint", "", "IMDS token endpoint, e.g. of an emulator. Empty to use the VM's IMDS.")
+	fs.StringVar(&node.FileRoot, "fileProviderRoot", "", "Directory of the trees and fixtures of the file provider. Empty to disable the file provider for the volumes.")
+	fs.StringVar(&node.StateDir, "stateDir", defaultStateDir, "Directory of the state of the driver on the node, e.g. the manifests of the files written in the volumes.")
+	registerTransportFlags(fs, &node.Transport)
+}
+
+// applyTo sets the settings of the node on the options of a volume
+func (node NodeOptions) applyTo(options *Option) {
+	options.cloudEnvFile = node.CloudEnvFile
+	options.msiEndpoint = node.MSIEndpoint
+	options.transport = node.Transport
+	options.stateDir = node.StateDir
+}
+
+// args returns the flags of the settings of the node
+func (node NodeOptions) args() []string {
+	return append([]string{"-cloudEnvFile=" + node.CloudEnvFile, "-msiEndpoint=" + node.MSIEndpoint, "-fileProviderRoot=" + node.FileRoot, "-stateDir=" + node.StateDir}, transportArgs(node.Transport)...)
+}
+
+// fileProviderPath resolves the filepath option of a volume, relative to the root of the file provider.
+// The symlinks are resolved so that the resolved path stays inside the root.
+func (node NodeOptions) fileProviderPath(filePath string) (string, error) {
+	if node.FileRoot == "" {
+		return "", fmt.Errorf("the file provider is disabled, -fileProviderRoot is not set on the driver")
+	}
+	root, err := filepath.EvalSymlinks(node.FileRoot)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid -fileProviderRoot %s", node.FileRoot)
+	}
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(root, filePath)
+	}
+	resolved, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid -filePath %s", filePath)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("-filePath %s is outside of the file provider root %s", filePath, node.FileRoot)
+	}
+	return resolved, nil
+}
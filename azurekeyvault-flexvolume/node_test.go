@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileProviderPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kv-file-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	fixture := filepath.Join(root, "fixture.yaml")
+	outside := filepath.Join(dir, "outside.yaml")
+	for _, path := range []string{fixture, outside} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("secrets: []\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(fixture, filepath.Join(root, "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fileRoot string
+		filePath string
+		// the resolved path, empty when it is refused
+		want string
+	}{
+		{name: "disabled", fileRoot: "", filePath: fixture},
+		{name: "relative", fileRoot: root, filePath: "fixture.yaml", want: fixture},
+		{name: "absolute inside", fileRoot: root, filePath: fixture, want: fixture},
+		{name: "root itself", fileRoot: root, filePath: root, want: root},
+		{name: "symlink inside", fileRoot: root, filePath: "link.yaml", want: fixture},
+		{name: "parent", fileRoot: root, filePath: "../outside.yaml"},
+		{name: "absolute outside", fileRoot: root, filePath: outside},
+		{name: "symlink outside", fileRoot: root, filePath: "escape.yaml"},
+		{name: "missing", fileRoot: root, filePath: "missing.yaml"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NodeOptions{FileRoot: test.fileRoot}.fileProviderPath(test.filePath)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("fileProviderPath(%q) = %q, want an error", test.filePath, got)
+				}
+				return
+			}
+			want, _ := filepath.EvalSymlinks(test.want)
+			if err != nil || got != want {
+				t.Errorf("fileProviderPath(%q) = %q, %v, want %q", test.filePath, got, err, want)
+			}
+		})
+	}
+}
@@ -8,8 +8,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -21,10 +24,20 @@ import (
 )
 
 const (
-	nmibase                     = "http://localhost"
-	nmipath                     = "host/token/"
-	podnameheader               = "podname"
-	podnsheader                 = "podns"
+	nmibase               = "http://localhost"
+	nmipath               = "host/token/"
+	podnameheader         = "podname"
+	podnsheader           = "podns"
+	imdsAPIVersion        = "2018-02-01"
+	imdsResourceIDParam   = "msi_res_id"
+	imdsObjectIDParam     = "object_id"
+	azureADIdentitySystem = "azure_ad"
+	clientAssertionType   = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	adfsIdentitySystem    = "adfs"
+)
+
+// retries of the NMI requests, variables so that the tests do not wait for NMI
+var (
 	podIdentityRetryDelay       = time.Duration(7 * time.Second)
 	podIdentityRetryMaxAttempts = 5
 )
@@ -43,6 +56,18 @@ const (
 	OAuthGrantTypeDeviceFlow
 )
 
+// Credential sources of a credential chain
+const (
+	// CredentialWorkloadIdentity federated service account token
+	CredentialWorkloadIdentity = "workload"
+	// CredentialPodIdentity aad-pod-identity NMI
+	CredentialPodIdentity = "pod"
+	// CredentialManagedIdentity VM managed identity
+	CredentialManagedIdentity = "msi"
+	// CredentialServicePrincipal AAD application client id and secret
+	CredentialServicePrincipal = "sp"
+)
+
 // AzureAuthConfig holds auth related part of cloud config
 type AzureAuthConfig struct {
 	// The cloud environment identifier. Takes values from https://github.com/Azure/go-autorest/blob/ec5f4903f77ed9927ac95b19ab8e44ada64c1356/autorest/azure/environments.go#L13
@@ -59,6 +84,10 @@ type AzureAuthConfig struct {
 	AADClientCertPassword string `json:"aadClientCertPassword"`
 	// Use managed service identity integrated with pod identity to get access to Azure ARM resources
 	UsePodIdentity bool `json:"usePodIdentity"`
+	// Use the managed identity of the VM
+	UseManagedIdentityExtension bool `json:"useManagedIdentityExtension"`
+	// The client ID of the user assigned identity of the VM, empty for the system assigned identity
+	UserAssignedIdentityID string `json:"userAssignedIdentityID"`
 }
 
 // Config holds the configuration parsed from the --cloud-config flag
@@ -84,22 +113,20 @@ type NMIResponse struct {
 	ClientID string     `json:"clientid"`
 }
 
-// GetKeyvaultToken retrieves a new service principal token to access keyvault
-func GetKeyvaultToken(grantType OAuthGrantType, cloudName, tenantID string, usePodIdentity, useVmManagedIdentity bool, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport string) (authorizer autorest.Authorizer, err error) {
+// IMDSResponse is the response received from the instance metadata service
+type IMDSResponse struct {
+	adal.Token
+	ClientID string `json:"client_id"`
+}
+
+// GetKeyvaultToken retrieves a new service principal token to access keyvault in the env cloud
+func GetKeyvaultToken(grantType OAuthGrantType, env *azure.Environment, tenantID string, credentials []string, msiEndpoint, vmManagedIdentityClientID, vmManagedIdentityResourceID, vmManagedIdentityObjectID, aADClientSecret, aADClientID, federatedTokenFile, federatedToken, podname, podns, nmiport string) (authorizer autorest.Authorizer, err error) {
 	err = adal.AddToUserAgent(GetUserAgent())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to add user agent to adal")
 	}
-	env, err := ParseAzureEnvironment(cloudName)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse Azure environment")
-	}
-
-	kvEndPoint := env.KeyVaultEndpoint
-	if '/' == kvEndPoint[len(kvEndPoint)-1] {
-		kvEndPoint = kvEndPoint[:len(kvEndPoint)-1]
-	}
-	servicePrincipalToken, err := GetServicePrincipalToken(tenantID, env, kvEndPoint, usePodIdentity, useVmManagedIdentity, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport)
+	kvEndPoint := getKeyvaultResource(env)
+	servicePrincipalToken, err := GetServicePrincipalToken(tenantID, env, kvEndPoint, credentials, msiEndpoint, vmManagedIdentityClientID, vmManagedIdentityResourceID, vmManagedIdentityObjectID, aADClientSecret, aADClientID, federatedTokenFile, federatedToken, podname, podns, nmiport)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get service principal token")
 	}
@@ -108,109 +135,272 @@ func GetKeyvaultToken(grantType OAuthGrantType, cloudName, tenantID string, useP
 
 }
 
-// GetServicePrincipalToken creates a new service principal token based on the configuration
-func GetServicePrincipalToken(tenantID string, env *azure.Environment, resource string, usePodIdentity bool, useVmManagedIdentity bool, vmManagedIdentityClientID, aADClientSecret, aADClientID, podname, podns, nmiport string) (*adal.ServicePrincipalToken, error) {
-	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+// CredentialChain returns the ordered credential sources to try. auth is a comma separated list of
+// sources; when it is empty the chain is the single source selected by the legacy flags.
+func CredentialChain(auth string, usePodIdentity, useVmManagedIdentity bool) ([]string, error) {
+	if auth == "" {
+		switch {
+		case usePodIdentity:
+			return []string{CredentialPodIdentity}, nil
+		case useVmManagedIdentity:
+			return []string{CredentialManagedIdentity}, nil
+		default:
+			return []string{CredentialServicePrincipal}, nil
+		}
+	}
+
+	var credentials []string
+	for _, credential := range strings.Split(auth, ",") {
+		credential = strings.ToLower(strings.TrimSpace(credential))
+		switch credential {
+		case CredentialWorkloadIdentity, CredentialPodIdentity, CredentialManagedIdentity, CredentialServicePrincipal:
+			credentials = append(credentials, credential)
+		default:
+			return nil, fmt.Errorf("invalid credential %q, should be one of workload, pod, msi or sp", credential)
+		}
+	}
+	return credentials, nil
+}
+
+// GetServicePrincipalToken tries each of the credential sources in order and returns the token of the
+// first one that succeeds. The returned error lists why each source failed.
+func GetServicePrincipalToken(tenantID string, env *azure.Environment, resource string, credentials []string, msiEndpoint, vmManagedIdentityClientID, vmManagedIdentityResourceID, vmManagedIdentityObjectID, aADClientSecret, aADClientID, federatedTokenFile, federatedToken, podname, podns, nmiport string) (*adal.ServicePrincipalToken, error) {
+	oauthConfig, err := getOAuthConfig(env, tenantID)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed creating the OAuth config")
 	}
 
-	// For usepodidentity mode, the flexvolume driver makes an authorization request to fetch token for a resource from the NMI host endpoint (http://127.0.0.1:nmiport/host/token/).
-	// The request includes the pod namespace `podns` and the pod name `podname` in the request header and the resource endpoint of the resource requesting the token.
-	// The NMI server identifies the pod based on the `podns` and `podname` in the request header and then queries k8s (through MIC) for a matching azure identity.
-	// Then nmi makes an adal request to get a token for the resource in the request, returns the `token` and the `clientid` as a reponse to the flexvolume request.
+	var failures []string
+	for _, credential := range credentials {
+		var spt *adal.ServicePrincipalToken
+		switch credential {
+		case CredentialWorkloadIdentity:
+			spt, err = getWorkloadIdentityToken(oauthConfig, resource, aADClientID, federatedTokenFile, federatedToken)
+		case CredentialPodIdentity:
+			spt, err = getPodIdentityToken(oauthConfig, resource, podname, podns, nmiport)
+		case CredentialManagedIdentity:
+			spt, err = getVMManagedIdentityToken(oauthConfig, resource, msiEndpoint, vmManagedIdentityClientID, vmManagedIdentityResourceID, vmManagedIdentityObjectID, podname, podns)
+		case CredentialServicePrincipal:
+			spt, err = getClientSecretToken(oauthConfig, resource, aADClientSecret, aADClientID, podname, podns)
+		default:
+			err = fmt.Errorf("unknown credential")
+		}
 
-	if usePodIdentity {
-		glog.V(0).Infof("azure: using pod identity to retrieve token for %s/%s", podns, podname)
-		glog.V(0).Infof("azure: connecting to nmi at %s:%s/%s", nmibase, nmiport, nmipath)
+		// tokens are acquired lazily by adal, refresh now so a failing source falls through to the next one
+		if err == nil {
+			spt.SetSender(httpClient)
+			err = spt.EnsureFresh()
+		}
+		if err == nil {
+			if len(credentials) > 1 {
+				glog.V(0).Infof("azure: using %s credential to retrieve token for %s/%s", credential, podns, podname)
+			}
+			return spt, nil
+		}
 
-		endpoint := fmt.Sprintf("%s:%s/%s?resource=%s", nmibase, nmiport, nmipath, resource)
-		req, err := http.NewRequest("GET", endpoint, nil)
-		if err != nil {
-			return nil, err
+		glog.V(2).Infof("azure: %s credential failed: %s", credential, err)
+		failures = append(failures, fmt.Sprintf("%s: %s", credential, err))
+	}
+
+	return nil, fmt.Errorf("no credential could retrieve a token: [%s]", strings.Join(failures, "; "))
+}
+
+// For usepodidentity mode, the flexvolume driver makes an authorization request to fetch token for a resource from the NMI host endpoint (http://127.0.0.1:nmiport/host/token/).
+// The request includes the pod namespace `podns` and the pod name `podname` in the request header and the resource endpoint of the resource requesting the token.
+// The NMI server identifies the pod based on the `podns` and `podname` in the request header and then queries k8s (through MIC) for a matching azure identity.
+// Then nmi makes an adal request to get a token for the resource in the request, returns the `token` and the `clientid` as a reponse to the flexvolume request.
+func getPodIdentityToken(oauthConfig *adal.OAuthConfig, resource, podname, podns, nmiport string) (*adal.ServicePrincipalToken, error) {
+	glog.V(0).Infof("azure: using pod identity to retrieve token for %s/%s", podns, podname)
+	glog.V(0).Infof("azure: connecting to nmi at %s:%s/%s", nmibase, nmiport, nmipath)
+
+	endpoint := fmt.Sprintf("%s:%s/%s?resource=%s", nmibase, nmiport, nmipath, resource)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(podnsheader, podns)
+	req.Header.Add(podnameheader, podname)
+
+	resp, err := retryFetchToken(req, podIdentityRetryMaxAttempts)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query NMI")
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("nmi response is nil")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			glog.Warning("failed to close NMI response body")
 		}
-		req.Header.Add(podnsheader, podns)
-		req.Header.Add(podnameheader, podname)
+	}()
+
+	if resp.StatusCode == http.StatusOK {
+		var nmiResp = NMIResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&nmiResp); err != nil {
+			return nil, errors.Wrap(err, "failed to decode NMI response")
+		}
+
+		r, _ := regexp.Compile("^(\\S{4})(\\S|\\s)*(\\S{4})$")
+		glog.V(2).Infof("accesstoken: %s", r.ReplaceAllString(nmiResp.Token.AccessToken, "$1##### REDACTED #####$3"))
+		glog.V(2).Infof("clientid: %s", r.ReplaceAllString(nmiResp.ClientID, "$1##### REDACTED #####$3"))
 
-		resp, err := retryFetchToken(req, podIdentityRetryMaxAttempts)
+		token := nmiResp.Token
+		clientID := nmiResp.ClientID
+
+		if &token == nil || clientID == "" {
+			return nil, fmt.Errorf("nmi did not return expected values in response: token and clientid")
+		}
+
+		spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, clientID, resource, token, nil)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to query NMI")
+			return nil, errors.Wrap(err, "failed to get new service principal token from manual token")
 		}
-		if resp == nil {
-			return nil, fmt.Errorf("nmi response is nil")
+		return spt, nil
+	}
+
+	return nil, fmt.Errorf("nmi response failed with status code: %d", resp.StatusCode)
+}
+
+// msiEndpoint overrides the IMDS token endpoint when it is set, e.g. to use an emulator
+func getVMManagedIdentityToken(oauthConfig *adal.OAuthConfig, resource, msiEndpoint, vmManagedIdentityClientID, vmManagedIdentityResourceID, vmManagedIdentityObjectID, podname, podns string) (*adal.ServicePrincipalToken, error) {
+	if msiEndpoint == "" {
+		var err error
+		if msiEndpoint, err = adal.GetMSIVMEndpoint(); err != nil {
+			return nil, errors.Wrap(err, "failed to get managed identity (MSI) endpoint")
 		}
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				fmt.Print("failed to close NMI response body")
-			}
-		}()
+	}
 
-		if resp.StatusCode == http.StatusOK {
-			var nmiResp = NMIResponse{}
-			if err := json.NewDecoder(resp.Body).Decode(&nmiResp); err != nil {
-				return nil, errors.Wrap(err, "failed to decode NMI response")
-			}
+	if vmManagedIdentityClientID != "" {
+		glog.V(2).Infof("azure: using user assigned managed identity %s to retrieve access token for %s/%s", vmManagedIdentityClientID, podns, podname)
+		return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(
+			msiEndpoint,
+			resource,
+			vmManagedIdentityClientID)
+	}
 
-			r, _ := regexp.Compile("^(\\S{4})(\\S|\\s)*(\\S{4})$")
-			fmt.Printf("\n accesstoken: %s\n", r.ReplaceAllString(nmiResp.Token.AccessToken, "$1##### REDACTED #####$3"))
-			fmt.Printf("\n clientid: %s\n", r.ReplaceAllString(nmiResp.ClientID, "$1##### REDACTED #####$3"))
+	// adal can only select a user assigned identity by its client ID, so the other selectors are sent to IMDS directly
+	if vmManagedIdentityResourceID != "" {
+		glog.V(2).Infof("azure: using user assigned managed identity %s to retrieve access token for %s/%s", vmManagedIdentityResourceID, podns, podname)
+		return getManagedIdentityToken(oauthConfig, msiEndpoint, resource, imdsResourceIDParam, vmManagedIdentityResourceID)
+	}
 
-			token := nmiResp.Token
-			clientID := nmiResp.ClientID
+	if vmManagedIdentityObjectID != "" {
+		glog.V(2).Infof("azure: using user assigned managed identity with object id %s to retrieve access token for %s/%s", vmManagedIdentityObjectID, podns, podname)
+		return getManagedIdentityToken(oauthConfig, msiEndpoint, resource, imdsObjectIDParam, vmManagedIdentityObjectID)
+	}
 
-			if &token == nil || clientID == "" {
-				return nil, fmt.Errorf("nmi did not return expected values in response: token and clientid")
-			}
+	glog.V(2).Infof("azure: using system assigned managed identity to retrieve access token for %s/%s", podns, podname)
+	return adal.NewServicePrincipalTokenFromMSI(
+		msiEndpoint,
+		resource)
+}
 
-			spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, clientID, resource, token, nil)
-			if err != nil {
-				return nil, errors.Wrap(err, "failed to get new service principal token from manual token")
-			}
-			return spt, nil
-		}
+// When flexvolume driver is using a Service Principal clientid + client secret to retrieve token for resource
+func getClientSecretToken(oauthConfig *adal.OAuthConfig, resource, aADClientSecret, aADClientID, podname, podns string) (*adal.ServicePrincipalToken, error) {
+	if len(aADClientSecret) == 0 {
+		return nil, fmt.Errorf("no credentials provided for AAD application %s", aADClientID)
+	}
+
+	glog.V(2).Infof("azure: using client_id+client_secret to retrieve access token for %s/%s", podns, podname)
+	return adal.NewServicePrincipalToken(
+		*oauthConfig,
+		aADClientID,
+		aADClientSecret,
+		resource)
+}
 
-		return nil, fmt.Errorf("nmi response failed with status code: %d", resp.StatusCode)
+// getWorkloadIdentityToken exchanges a federated service account token for a token of the AAD application.
+// The token of the pod, passed by the CSI driver, takes precedence over the token file of the driver.
+func getWorkloadIdentityToken(oauthConfig *adal.OAuthConfig, resource, aADClientID, federatedTokenFile, federatedToken string) (*adal.ServicePrincipalToken, error) {
+	if aADClientID == "" || (federatedTokenFile == "" && federatedToken == "") {
+		return nil, fmt.Errorf("workload identity requires a client id and a federated token")
 	}
 
-	if useVmManagedIdentity {
-		msiEndpoint, err := adal.GetMSIVMEndpoint()
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to get managed identity (MSI) endpoint")
+	secret := &federatedTokenSecret{tokenFile: federatedTokenFile}
+	if federatedToken != "" {
+		secret = &federatedTokenSecret{token: federatedToken}
+		glog.V(2).Infof("azure: using the federated token of the pod to retrieve access token for %s", aADClientID)
+	} else {
+		glog.V(2).Infof("azure: using federated token %s to retrieve access token for %s", federatedTokenFile, aADClientID)
+	}
+	return adal.NewServicePrincipalTokenWithSecret(
+		*oauthConfig,
+		aADClientID,
+		resource,
+		secret)
+}
+
+// federatedTokenSecret authenticates with a federated token as client assertion.
+// The file is read on every refresh because the kubelet rotates projected tokens.
+type federatedTokenSecret struct {
+	tokenFile string
+	// the token itself, when there is no file
+	token string
+}
+
+// SetAuthenticationValues is a method of the interface ServicePrincipalSecret
+func (secret *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	token := []byte(secret.token)
+	if secret.tokenFile != "" {
+		var err error
+		if token, err = ioutil.ReadFile(secret.tokenFile); err != nil {
+			return errors.Wrapf(err, "failed to read federated token file %s", secret.tokenFile)
 		}
+	}
+	v.Set("client_assertion_type", clientAssertionType)
+	v.Set("client_assertion", strings.TrimSpace(string(token)))
+	return nil
+}
 
-		if vmManagedIdentityClientID != "" {
-			glog.V(2).Infof("azure: using user assigned managed identity %s to retrieve access token for %s/%s", vmManagedIdentityClientID, podns, podname)
-			return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(
-				msiEndpoint,
-				resource,
-				vmManagedIdentityClientID)
+// getManagedIdentityToken requests a token for resource from IMDS, selecting the user assigned identity
+// with the given query parameter (msi_res_id or object_id).
+func getManagedIdentityToken(oauthConfig *adal.OAuthConfig, msiEndpoint, resource, selectorParam, selectorValue string) (*adal.ServicePrincipalToken, error) {
+	req, err := http.NewRequest("GET", msiEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata", "true")
+	query := req.URL.Query()
+	query.Set("api-version", imdsAPIVersion)
+	query.Set("resource", resource)
+	query.Set(selectorParam, selectorValue)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query IMDS")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			glog.Warning("failed to close IMDS response body")
 		}
+	}()
 
-		glog.V(2).Infof("azure: using system assigned managed identity to retrieve access token for %s/%s", podns, podname)
-		return adal.NewServicePrincipalTokenFromMSI(
-			msiEndpoint,
-			resource)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("IMDS response failed with status code: %d, %s", resp.StatusCode, string(body))
 	}
 
-	// When flexvolume driver is using a Service Principal clientid + client secret to retrieve token for resource
-	if len(aADClientSecret) > 0 {
-		glog.V(2).Infof("azure: using client_id+client_secret to retrieve access token for %s/%s", podns, podname)
-		return adal.NewServicePrincipalToken(
-			*oauthConfig,
-			aADClientID,
-			aADClientSecret,
-			resource)
+	var imdsResp IMDSResponse
+	if err := json.NewDecoder(resp.Body).Decode(&imdsResp); err != nil {
+		return nil, errors.Wrap(err, "failed to decode IMDS response")
+	}
+	if imdsResp.AccessToken == "" {
+		return nil, fmt.Errorf("IMDS did not return expected values in response: access_token")
 	}
 
-	return nil, fmt.Errorf("no credentials provided for AAD application %s", aADClientID)
+	spt, err := adal.NewServicePrincipalTokenFromManualToken(*oauthConfig, imdsResp.ClientID, resource, imdsResp.Token, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get new service principal token from manual token")
+	}
+	return spt, nil
 }
 
 func retryFetchToken(req *http.Request, maxAttempts int) (resp *http.Response, err error) {
 	attempt := 0
 
-	client := &http.Client{}
 	for attempt < maxAttempts {
-		resp, err = client.Do(req)
+		resp, err = httpClient.Do(req)
 
 		// pod-identity calls will be retried in every scenario except when the err is nil
 		// and we get 200 response code.
@@ -236,11 +426,40 @@ func retryFetchToken(req *http.Request, maxAttempts int) (resp *http.Response, e
 	return
 }
 
-// ParseAzureEnvironment returns azure environment by name
-func ParseAzureEnvironment(cloudName string) (*azure.Environment, error) {
+// ParseAzureEnvironment returns azure environment by name, or the custom environment
+// described in cloudEnvFile (e.g. Azure Stack Hub or an air-gapped cloud) when it is set
+func ParseAzureEnvironment(cloudName, cloudEnvFile string) (*azure.Environment, error) {
+	if cloudEnvFile != "" {
+		env, err := azure.EnvironmentFromFile(cloudEnvFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get environment from cloudEnvFile: %s", cloudEnvFile)
+		}
+		if env.ActiveDirectoryEndpoint == "" || env.KeyVaultDNSSuffix == "" || getKeyvaultResource(&env) == "" {
+			return nil, fmt.Errorf("cloudEnvFile %s must define activeDirectoryEndpoint, keyVaultDNSSuffix and keyVaultEndpoint", cloudEnvFile)
+		}
+		return &env, nil
+	}
 	if cloudName == "" {
 		return &azure.PublicCloud, nil
 	}
 	env, err := azure.EnvironmentFromName(cloudName)
 	return &env, errors.Wrapf(err, "failed to get environment from cloudName: %s", cloudName)
 }
+
+// getKeyvaultResource returns the resource to request key vault tokens for, without a trailing slash
+func getKeyvaultResource(env *azure.Environment) string {
+	resource := env.ResourceIdentifiers.KeyVault
+	if resource == "" || resource == azure.NotAvailable {
+		resource = env.KeyVaultEndpoint
+	}
+	return strings.TrimSuffix(resource, "/")
+}
+
+// getOAuthConfig returns the OAuth config for tenantID. ADFS tenants (Azure Stack Hub with ADFS
+// as the identity system) use the "adfs" tenant and do not accept the AAD api-version.
+func getOAuthConfig(env *azure.Environment, tenantID string) (*adal.OAuthConfig, error) {
+	if strings.EqualFold(tenantID, adfsIdentitySystem) {
+		return adal.NewOAuthConfigWithAPIVersion(env.ActiveDirectoryEndpoint, adfsIdentitySystem, nil)
+	}
+	return adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCredentialChain(t *testing.T) {
+	tests := []struct {
+		name                 string
+		auth                 string
+		usePodIdentity       bool
+		useVmManagedIdentity bool
+		want                 []string
+		// a part of the expected error
+		wantErr string
+	}{
+		{name: "default", want: []string{CredentialServicePrincipal}},
+		{name: "pod identity flag", usePodIdentity: true, want: []string{CredentialPodIdentity}},
+		{name: "managed identity flag", useVmManagedIdentity: true, want: []string{CredentialManagedIdentity}},
+		{name: "pod identity flag first", usePodIdentity: true, useVmManagedIdentity: true, want: []string{CredentialPodIdentity}},
+		{name: "single source", auth: "msi", want: []string{CredentialManagedIdentity}},
+		{
+			name: "order is kept", auth: "sp,msi,pod,workload",
+			want: []string{CredentialServicePrincipal, CredentialManagedIdentity, CredentialPodIdentity, CredentialWorkloadIdentity},
+		},
+		{name: "spaces and case", auth: " Workload , SP ", want: []string{CredentialWorkloadIdentity, CredentialServicePrincipal}},
+		{name: "auth overrides the flags", auth: "sp", usePodIdentity: true, useVmManagedIdentity: true, want: []string{CredentialServicePrincipal}},
+		{name: "unknown source", auth: "pod,kerberos", wantErr: `invalid credential "kerberos"`},
+		{name: "empty source", auth: "pod,,sp", wantErr: `invalid credential ""`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := CredentialChain(test.auth, test.usePodIdentity, test.useVmManagedIdentity)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("CredentialChain(%q) = %v, want %v", test.auth, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetServicePrincipalTokenChain(t *testing.T) {
+	delay, attempts := podIdentityRetryDelay, podIdentityRetryMaxAttempts
+	podIdentityRetryDelay, podIdentityRetryMaxAttempts = 0, 1
+	defer func() { podIdentityRetryDelay, podIdentityRetryMaxAttempts = delay, attempts }()
+
+	const (
+		nmi  = "/" + nmipath
+		imds = "/metadata/identity/oauth2/token"
+		aad  = "/" + testTenantID + "/oauth2/token"
+	)
+	tests := []struct {
+		name string
+		auth string
+		// the pod of the NMI requests, NMI fails without it
+		podName string
+		// the IMDS endpoint, relative to the identity server
+		msiEndpoint string
+		secret      string
+		// the paths requested, in order
+		wantPaths []string
+		// the parts of the expected error, in order
+		wantErr []string
+	}{
+		{
+			name: "first source succeeds", auth: "pod,msi,sp",
+			podName: "nginx", msiEndpoint: imds, secret: testClientSecret,
+			wantPaths: []string{nmi},
+		},
+		{
+			name: "pod identity falls back to managed identity", auth: "pod,msi,sp",
+			msiEndpoint: imds, secret: testClientSecret,
+			wantPaths: []string{nmi, imds},
+		},
+		{
+			name: "pod and managed identity fall back to the service principal", auth: "pod,msi,sp",
+			msiEndpoint: "/missing", secret: testClientSecret,
+			wantPaths: []string{nmi, "/missing", aad},
+		},
+		{
+			name: "order of auth", auth: "sp,pod",
+			podName: "nginx", secret: testClientSecret,
+			wantPaths: []string{aad},
+		},
+		{
+			name: "every source fails", auth: "pod,msi,sp",
+			msiEndpoint: "/missing", secret: "wrong",
+			wantPaths: []string{nmi, "/missing", aad},
+			wantErr:   []string{"no credential could retrieve a token", "pod: ", "nmi response failed with status code: 400", "msi: ", "status code: 404", "sp: "},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			emulator := startTestEmulator(t, FileFixture{}, nil)
+			defer emulator.stop()
+			options := emulator.options()
+
+			env, err := ParseAzureEnvironment("", filepath.Join(emulator.dir, "env.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			credentials, err := CredentialChain(test.auth, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a resource id selects the identity without the retries of adal
+			spt, err := GetServicePrincipalToken(testTenantID, env, emulator.resource, credentials,
+				emulator.identity.URL+test.msiEndpoint, "", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id", "",
+				test.secret, testClientID, "", "", test.podName, "default", options.nmiPort)
+
+			if len(test.wantErr) > 0 {
+				if err == nil {
+					t.Fatalf("GetServicePrincipalToken succeeded, want %q", test.wantErr)
+				}
+				message := err.Error()
+				for _, part := range test.wantErr {
+					index := strings.Index(message, part)
+					if index < 0 {
+						t.Fatalf("error %q does not contain %q after the previous parts", err, part)
+					}
+					message = message[index+len(part):]
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if spt.Token().IsExpired() || spt.Token().Expires().Before(time.Now()) {
+					t.Errorf("the token is expired")
+				}
+			}
+			if !reflect.DeepEqual(emulator.paths, test.wantPaths) {
+				t.Errorf("requests = %v, want %v", emulator.paths, test.wantPaths)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/secrets-store-csi-driver/provider/v1alpha1"
+)
+
+const (
+	// the secrets store CSI driver connects to <providers dir>/<provider>.sock,
+	// provider being the provider field of the SecretProviderClass
+	providerEndpoint   = "unix:///etc/kubernetes/secrets-store-csi-providers/keyvault.sock"
+	providerAPIVersion = "v1alpha1"
+)
+
+// ProviderServer implements the secrets store CSI driver provider service. Mount takes the
+// flexVolume options as SecretProviderClass parameters and returns the objects as files.
+type ProviderServer struct {
+	v1alpha1.UnimplementedCSIDriverProviderServer
+
+	// settings of the node
+	node NodeOptions
+}
+
+// runProvider is the provider subcommand, it serves the provider service until it is terminated
+func runProvider(args []string) int {
+	var endpoint string
+	provider := &ProviderServer{}
+	flag.StringVar(&endpoint, "endpoint", providerEndpoint, "Provider endpoint.")
+	registerNodeFlags(flag.CommandLine, &provider.node)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 1
+	}
+	defer glog.Flush()
+
+	if err := configureHTTPClient(provider.node.Transport); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	listener, err := listenUnix(endpoint)
+	if err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logGRPC))
+	v1alpha1.RegisterCSIDriverProviderServer(server, provider)
+	stopOnSignal(server)
+
+	glog.Infof("starting the %s %s secrets store provider on %s", program, version, endpoint)
+	if err := server.Serve(listener); err != nil {
+		glog.Errorf("[error] : %s", err)
+		return 1
+	}
+	return 0
+}
+
+// Version returns the provider API version and the version of the provider
+func (server *ProviderServer) Version(ctx context.Context, req *v1alpha1.VersionRequest) (*v1alpha1.VersionResponse, error) {
+	return &v1alpha1.VersionResponse{
+		Version:        providerAPIVersion,
+		RuntimeName:    program,
+		RuntimeVersion: version,
+	}, nil
+}
+
+// Mount fetches the objects of a SecretProviderClass and returns them with their versions,
+// the driver writes the files and compares the versions to detect rotations
+func (server *ProviderServer) Mount(ctx context.Context, req *v1alpha1.MountRequest) (*v1alpha1.MountResponse, error) {
+	var attributes, secrets map[string]string
+	var filePermission os.FileMode
+	if err := json.Unmarshal([]byte(req.GetAttributes()), &attributes); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to parse attributes: %s", err)
+	}
+	if err := json.Unmarshal([]byte(req.GetSecrets()), &secrets); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to parse secrets: %s", err)
+	}
+	if err := json.Unmarshal([]byte(req.GetPermission()), &filePermission); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to parse permission: %s", err)
+	}
+
+	options, err := optionsFromParams(csiVolumeParams(attributes, secrets), server.node)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	options.dir = req.GetTargetPath()
+	applyPodTokens(options, attributes[csiServiceAccountTokens])
+	if err := Validate(*options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the secrets store driver only writes files, it cannot host the socket of an agent
+	if options.agent || options.sshAgent {
+		return nil, status.Error(codes.InvalidArgument, "agent and sshagent are not supported by the secrets store provider")
+	}
+
+	adapter := &KeyvaultFlexvolumeAdapter{ctx: ctx, options: *options}
+	objects, err := adapter.FetchObjects()
+	if err != nil {
+		return nil, status.Error(codes.Internal, errors.Wrapf(err, "failed to mount %s", options.dir).Error())
+	}
+
+	resp := &v1alpha1.MountResponse{}
+	for _, object := range objects {
+		resp.Files = append(resp.Files, &v1alpha1.File{
+			Path:     object.FileName,
+			Mode:     int32(filePermission),
+			Contents: object.Content,
+		})
+		// an object can be written to several files, e.g. a keystore and its password
+		resp.ObjectVersion = append(resp.ObjectVersion, &v1alpha1.ObjectVersion{
+			Id:      object.Type + "/" + object.Name + "/" + object.FileName,
+			Version: object.Version,
+		})
+	}
+	return resp, nil
+}
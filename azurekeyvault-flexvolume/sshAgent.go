@@ -0,0 +1,231 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentSocketName is the ssh-agent socket of the agent, in the mount directory
+const sshAgentSocketName = "ssh-agent.sock"
+
+// sha1DigestInfo is the DER prefix of a SHA-1 digest in a PKCS #1 v1.5 signature, Key Vault
+// has no SHA-1 algorithm so ssh-rsa signatures are made with RSNULL
+var sha1DigestInfo = []byte{0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14}
+
+var errSSHAgentReadOnly = fmt.Errorf("the keys of the agent are in key vault, they cannot be added, removed or locked")
+
+// SSHAgent serves the keys of an agent as SSH identities with the ssh-agent protocol, the
+// signatures are made by Key Vault
+type SSHAgent struct {
+	agent *Agent
+}
+
+// sshIdentity is a key of the agent with its SSH public key
+type sshIdentity struct {
+	alias     string
+	key       agentKey
+	publicKey ssh.PublicKey
+}
+
+// serve serves the ssh-agent protocol on listener until it is closed
+func (sshAgent *SSHAgent) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := agent.ServeAgent(sshAgent, conn); err != nil && !strings.Contains(err.Error(), "EOF") {
+				glog.Warningf("ssh-agent: %s", err)
+			}
+		}()
+	}
+}
+
+// identities returns the keys of the agent with their SSH public keys, by alias
+func (sshAgent *SSHAgent) identities() ([]sshIdentity, error) {
+	backend, err := sshAgent.agent.backend()
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for alias := range sshAgent.agent.keys {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	var identities []sshIdentity
+	for _, alias := range aliases {
+		key := sshAgent.agent.keys[alias]
+		bundle, err := backend.GetKey(context.Background(), key.name, key.version)
+		if err != nil {
+			return nil, sanitisedError(err, VaultTypeKey, key.name, key.version)
+		}
+		publicKey, err := jsonWebKeyPublicKey(bundle.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %s", key.name, err)
+		}
+		sshKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s cannot be used with ssh: %s", key.name, err)
+		}
+		identities = append(identities, sshIdentity{alias: alias, key: key, publicKey: sshKey})
+	}
+	return identities, nil
+}
+
+// List returns the keys of the agent, with their alias as comment
+func (sshAgent *SSHAgent) List() ([]*agent.Key, error) {
+	identities, err := sshAgent.identities()
+	if err != nil {
+		glog.Errorf("ssh-agent: %s", err)
+		return nil, err
+	}
+	var keys []*agent.Key
+	for _, identity := range identities {
+		keys = append(keys, &agent.Key{Format: identity.publicKey.Type(), Blob: identity.publicKey.Marshal(), Comment: identity.alias})
+	}
+	return keys, nil
+}
+
+// Sign signs data with ssh-rsa for RSA keys
+func (sshAgent *SSHAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return sshAgent.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs data with Key Vault, with rsa-sha2-256 or rsa-sha2-512 for RSA keys when requested
+func (sshAgent *SSHAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	identities, err := sshAgent.identities()
+	if err != nil {
+		glog.Errorf("ssh-agent: %s", err)
+		return nil, err
+	}
+	var identity *sshIdentity
+	for i := range identities {
+		if bytes.Equal(identities[i].publicKey.Marshal(), key.Marshal()) {
+			identity = &identities[i]
+		}
+	}
+	if identity == nil {
+		return nil, fmt.Errorf("the key is not served by the agent")
+	}
+
+	var format, alg string
+	var hash crypto.Hash
+	switch publicKey := identity.publicKey.(ssh.CryptoPublicKey).CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		switch {
+		case flags&agent.SignatureFlagRsaSha256 != 0:
+			format, alg, hash = ssh.KeyAlgoRSASHA256, "RS256", crypto.SHA256
+		case flags&agent.SignatureFlagRsaSha512 != 0:
+			format, alg, hash = ssh.KeyAlgoRSASHA512, "RS512", crypto.SHA512
+		default:
+			format, alg, hash = ssh.KeyAlgoRSA, algorithmRSNULL, crypto.SHA1
+		}
+	case *ecdsa.PublicKey:
+		format = identity.publicKey.Type()
+		switch publicKey.Curve {
+		case elliptic.P256():
+			alg, hash = "ES256", crypto.SHA256
+		case elliptic.P384():
+			alg, hash = "ES384", crypto.SHA384
+		default:
+			alg, hash = "ES512", crypto.SHA512
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", identity.publicKey.Type())
+	}
+
+	digest := hash.New()
+	digest.Write(data)
+	value := digest.Sum(nil)
+	if alg == algorithmRSNULL {
+		value = append(append([]byte{}, sha1DigestInfo...), value...)
+	}
+	signature, err := sshAgent.sign(identity.key, alg, value)
+	if err != nil {
+		glog.Errorf("ssh-agent: failed to sign with %s: %s", identity.key.name, err)
+		return nil, err
+	}
+	glog.V(2).Infof("ssh-agent: signed with key %s (version: %s) and algorithm %s", identity.key.name, identity.key.version, alg)
+
+	if strings.HasPrefix(alg, "ES") {
+		// ssh encodes r and s as mpints
+		size := len(signature) / 2
+		signature = ssh.Marshal(struct {
+			R *big.Int
+			S *big.Int
+		}{new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])})
+	}
+	return &ssh.Signature{Format: format, Blob: signature}, nil
+}
+
+// sign signs a value with a key of the agent in Key Vault
+func (sshAgent *SSHAgent) sign(key agentKey, alg string, value []byte) ([]byte, error) {
+	backend, err := sshAgent.agent.backend()
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(value)
+	result, err := backend.client.Sign(context.Background(), backend.vaultURL, key.name, key.version, kv.KeySignParameters{Algorithm: kv.JSONWebKeySignatureAlgorithm(alg), Value: &encoded})
+	if err != nil {
+		return nil, sanitisedError(err, VaultTypeKey, key.name, key.version)
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(stringValue(result.Result), "="))
+}
+
+// Add is not supported, the keys are in Key Vault
+func (sshAgent *SSHAgent) Add(key agent.AddedKey) error {
+	return errSSHAgentReadOnly
+}
+
+// Remove is not supported, the keys are in Key Vault
+func (sshAgent *SSHAgent) Remove(key ssh.PublicKey) error {
+	return errSSHAgentReadOnly
+}
+
+// RemoveAll is not supported, the keys are in Key Vault
+func (sshAgent *SSHAgent) RemoveAll() error {
+	return errSSHAgentReadOnly
+}
+
+// Lock is not supported, the keys are in Key Vault
+func (sshAgent *SSHAgent) Lock(passphrase []byte) error {
+	return errSSHAgentReadOnly
+}
+
+// Unlock is not supported, the keys are in Key Vault
+func (sshAgent *SSHAgent) Unlock(passphrase []byte) error {
+	return errSSHAgentReadOnly
+}
+
+// Signers is not supported, the private keys never leave Key Vault
+func (sshAgent *SSHAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errSSHAgentReadOnly
+}
+
+// Extension is not supported
+func (sshAgent *SSHAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
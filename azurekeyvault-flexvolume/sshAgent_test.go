@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHAgentSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator := startTestEmulator(t, FileFixture{Keys: []FileObject{
+		{Name: "deploy", Version: "1", PEM: testKeyPEM(t, rsaKey)},
+		{Name: "git", Version: "1", PEM: testKeyPEM(t, ecKey)},
+	}}, nil)
+	defer emulator.stop()
+	options := emulator.options()
+	options.vaultObjectNames = "deploy;git"
+	options.vaultObjectTypes = "key;key"
+	keyAgent, err := newAgent(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "kv-ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := listenAgentSocket(dir, sshAgentSocketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() { _ = (&SSHAgent{agent: keyAgent}).serve(listener) }()
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "deploy" || keys[0].Type() != ssh.KeyAlgoRSA || keys[1].Comment != "git" || keys[1].Type() != ssh.KeyAlgoECDSA256 {
+		t.Fatalf("keys = %v, want the RSA and EC keys with their alias", keys)
+	}
+
+	data := []byte("session data")
+	tests := []struct {
+		name   string
+		key    *agent.Key
+		flags  agent.SignatureFlags
+		format string
+	}{
+		{name: "ssh-rsa", key: keys[0], format: ssh.KeyAlgoRSA},
+		{name: "rsa-sha2-256", key: keys[0], flags: agent.SignatureFlagRsaSha256, format: ssh.KeyAlgoRSASHA256},
+		{name: "rsa-sha2-512", key: keys[0], flags: agent.SignatureFlagRsaSha512, format: ssh.KeyAlgoRSASHA512},
+		{name: "ecdsa", key: keys[1], format: ssh.KeyAlgoECDSA256},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signature, err := client.SignWithFlags(test.key, data, test.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signature.Format != test.format {
+				t.Errorf("format = %s, want %s", signature.Format, test.format)
+			}
+			if err := test.key.Verify(data, signature); err != nil {
+				t.Errorf("the signature is invalid: %s", err)
+			}
+			if err := test.key.Verify([]byte("other data"), signature); err == nil {
+				t.Errorf("the signature is valid for other data")
+			}
+		})
+	}
+
+	other, err := ssh.NewPublicKey(&otherKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Sign(other, data); err == nil {
+		t.Errorf("signed with a key that is not served")
+	}
+	if err := client.Add(agent.AddedKey{PrivateKey: otherKey}); err == nil {
+		t.Errorf("a key is added to the agent")
+	}
+	if err := client.RemoveAll(); err == nil {
+		t.Errorf("the keys of the agent are removed")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	// IMDS is link-local and must never be reached through a proxy
+	imdsHost = "169.254.169.254"
+)
+
+var (
+	// httpClient is shared by every outbound call: Key Vault, AAD, IMDS and NMI
+	httpClient = &http.Client{}
+)
+
+// TransportOptions configures the shared HTTP transport
+type TransportOptions struct {
+	// overall timeout of a request, including reading the response body
+	Timeout time.Duration
+	// timeout to establish a TCP connection
+	DialTimeout time.Duration
+	// timeout to complete the TLS handshake
+	TLSHandshakeTimeout time.Duration
+	// TCP keep-alive period of the connections
+	KeepAlive time.Duration
+	// how long an idle connection is kept for reuse
+	IdleConnTimeout time.Duration
+	// path to a PEM bundle of CAs to trust in addition to the system roots
+	CABundle string
+	// proxy for https requests, defaults to HTTPS_PROXY
+	HTTPSProxy string
+	// hosts excluded from proxying, defaults to NO_PROXY
+	NoProxy string
+}
+
+// configureHTTPClient replaces the shared HTTP client with one built from options
+func configureHTTPClient(options TransportOptions) error {
+	client, err := newHTTPClient(options)
+	if err != nil {
+		return err
+	}
+	httpClient = client
+	return nil
+}
+
+func newHTTPClient(options TransportOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if options.CABundle != "" {
+		rootCAs, err := loadCABundle(options.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	transport := &http.Transport{
+		Proxy: proxyFunc(options.HTTPSProxy, options.NoProxy),
+		DialContext: (&net.Dialer{
+			Timeout:   options.DialTimeout,
+			KeepAlive: options.KeepAlive,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   options.TLSHandshakeTimeout,
+		IdleConnTimeout:       options.IdleConnTimeout,
+		MaxIdleConns:          10,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   options.Timeout,
+	}, nil
+}
+
+// loadCABundle returns the system roots extended with the certificates in the PEM file at path
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CA bundle %s", path)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %s does not contain any PEM certificate", path)
+	}
+	return rootCAs, nil
+}
+
+// proxyFunc honours HTTPS_PROXY/NO_PROXY, overridden by the given values when set.
+// Requests to localhost (NMI) and to IMDS always bypass the proxy.
+func proxyFunc(httpsProxy, noProxy string) func(*http.Request) (*url.URL, error) {
+	config := httpproxy.FromEnvironment()
+	if httpsProxy != "" {
+		config.HTTPSProxy = httpsProxy
+	}
+	if noProxy != "" {
+		config.NoProxy = noProxy
+	}
+	config.NoProxy = strings.Join([]string{config.NoProxy, imdsHost}, ",")
+	proxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
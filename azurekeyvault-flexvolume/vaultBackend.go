@@ -0,0 +1,321 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// content type of the secret of an issued certificate
+	pemContentType = "application/x-pem-file"
+)
+
+// errVaultCertificateNotIssued is returned for certificates when the objects are only inspected
+var errVaultCertificateNotIssued = fmt.Errorf("certificates are issued on every mount by the vault provider, they are not issued to be inspected")
+
+// VaultBackend is the Backend of HashiCorp Vault: secrets are read from a KV v2 engine
+// and certificates are issued by a PKI engine. Keys are not supported.
+type VaultBackend struct {
+	address string
+	token   string
+	kvPath  string
+	pkiPath string
+	pkiRole string
+	// the objects are only inspected, certificates are not issued
+	readOnly bool
+	// the private key and chain of the issued certificates, by name and serial number, returned
+	// as their secret like the backing secret of a Key Vault certificate
+	issued map[string]*ObjectBundle
+}
+
+// vaultResponse is the envelope of the Vault API responses
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Auth   *vaultAuth      `json:"auth"`
+	Errors []string        `json:"errors"`
+}
+
+type vaultAuth struct {
+	ClientToken string `json:"client_token"`
+}
+
+type vaultKVMetadata struct {
+	CreatedTime  string `json:"created_time"`
+	DeletionTime string `json:"deletion_time"`
+	Destroyed    bool   `json:"destroyed"`
+	Version      int    `json:"version"`
+}
+
+func newVaultBackend(ctx context.Context, options Option) (Backend, error) {
+	backend := &VaultBackend{
+		address: strings.TrimSuffix(options.vaultAddr, "/"),
+		token:   options.vaultToken,
+		kvPath:  strings.Trim(options.vaultKVPath, "/"),
+		pkiPath: strings.Trim(options.vaultPKIPath, "/"),
+		pkiRole: options.vaultPKIRole,
+		// dry runs and admin commands must not issue certificates
+		readOnly: options.readOnly || options.dryRun,
+		issued:   map[string]*ObjectBundle{},
+	}
+	if backend.token != "" {
+		return backend, nil
+	}
+
+	jwt := options.vaultServiceAccountToken
+	if jwt == "" && options.vaultServiceAccountTokenFile == "" {
+		return nil, fmt.Errorf("no service account token for the vault kubernetes login, the CSIDriver object must request a token for the pod")
+	}
+	if jwt == "" {
+		content, err := ioutil.ReadFile(options.vaultServiceAccountTokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the service account token")
+		}
+		jwt = strings.TrimSpace(string(content))
+	}
+
+	login := map[string]string{"role": options.vaultRole, "jwt": jwt}
+	var resp vaultResponse
+	loginPath := path.Join("auth", strings.Trim(options.vaultAuthPath, "/"), "login")
+	if err := backend.do(ctx, "POST", loginPath, nil, login, &resp); err != nil {
+		return nil, errors.Wrap(err, "vault kubernetes login failed")
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault kubernetes login returned no token")
+	}
+	glog.V(2).Infof("vault: logged in with role %s", options.vaultRole)
+	backend.token = resp.Auth.ClientToken
+	return backend, nil
+}
+
+// GetSecret returns a KV v2 secret. The value is its "value" field when it is the only one,
+// the JSON encoded fields otherwise.
+func (backend *VaultBackend) GetSecret(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	// the serial number of an issued certificate is never a KV version
+	if secret, ok := backend.issued[name+"/"+version]; ok {
+		return secret, nil
+	}
+	query := url.Values{}
+	if version != "" {
+		query.Set("version", version)
+	}
+	var data struct {
+		Data     map[string]interface{} `json:"data"`
+		Metadata vaultKVMetadata        `json:"metadata"`
+	}
+	if err := backend.read(ctx, "GET", path.Join(backend.kvPath, "data", name), query, nil, &data); err != nil {
+		return nil, err
+	}
+	if data.Data == nil {
+		return nil, fmt.Errorf("secret %s version %s is deleted", name, version)
+	}
+
+	bundle := &ObjectBundle{ObjectItem: kvItem(name, data.Metadata)}
+	if value, ok := data.Data["value"].(string); ok && len(data.Data) == 1 {
+		bundle.Value = []byte(value)
+	} else {
+		value, err := json.Marshal(data.Data)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Value = value
+		bundle.ContentType = "application/json"
+	}
+	return bundle, nil
+}
+
+// GetKey is not supported, Vault keys never leave the transit engine
+func (backend *VaultBackend) GetKey(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	return nil, fmt.Errorf("keys are not supported by the vault provider")
+}
+
+// GetCertificate issues a certificate for the common name name with the PKI role.
+// The version is the serial number of the issued certificate, and its private key and
+// chain are kept as the secret of the same name and version.
+func (backend *VaultBackend) GetCertificate(ctx context.Context, name, version string) (*ObjectBundle, error) {
+	if version != "" {
+		return nil, fmt.Errorf("certificates are issued on every mount, versions are not supported by the vault provider")
+	}
+	if backend.readOnly {
+		return nil, errVaultCertificateNotIssued
+	}
+	var data struct {
+		Certificate  string   `json:"certificate"`
+		PrivateKey   string   `json:"private_key"`
+		CAChain      []string `json:"ca_chain"`
+		IssuingCA    string   `json:"issuing_ca"`
+		SerialNumber string   `json:"serial_number"`
+		Expiration   int64    `json:"expiration"`
+	}
+	issue := map[string]string{"common_name": name}
+	if err := backend.read(ctx, "POST", path.Join(backend.pkiPath, "issue", backend.pkiRole), nil, issue, &data); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(data.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("vault issued an invalid certificate for %s", name)
+	}
+
+	enabled := true
+	expires := time.Unix(data.Expiration, 0)
+	bundle := &ObjectBundle{
+		ObjectItem: ObjectItem{Type: VaultTypeCertificate, Name: name, Version: data.SerialNumber, Enabled: &enabled, Expires: &expires},
+		Value:      block.Bytes,
+	}
+
+	chain := data.CAChain
+	if len(chain) == 0 && data.IssuingCA != "" {
+		chain = []string{data.IssuingCA}
+	}
+	secret := strings.Join(append([]string{data.PrivateKey, data.Certificate}, chain...), "\n")
+	backend.issued[name+"/"+data.SerialNumber] = &ObjectBundle{
+		ObjectItem:  ObjectItem{Type: VaultTypeSecret, Name: name, Version: data.SerialNumber, Enabled: &enabled, Expires: &expires},
+		Value:       []byte(secret),
+		ContentType: pemContentType,
+	}
+	return bundle, nil
+}
+
+// List returns the secrets of the KV engine or the serial numbers of the certificates of the PKI engine
+func (backend *VaultBackend) List(ctx context.Context, objectType string) ([]ObjectItem, error) {
+	var listPath string
+	switch objectType {
+	case VaultTypeSecret:
+		listPath = path.Join(backend.kvPath, "metadata")
+	case VaultTypeCertificate:
+		listPath = path.Join(backend.pkiPath, "certs")
+	default:
+		return nil, fmt.Errorf("%s objects are not supported by the vault provider", objectType)
+	}
+
+	var data struct {
+		Keys []string `json:"keys"`
+	}
+	if err := backend.read(ctx, "LIST", listPath+"/", nil, nil, &data); err != nil {
+		return nil, err
+	}
+	var items []ObjectItem
+	for _, key := range data.Keys {
+		items = append(items, ObjectItem{Type: objectType, Name: key})
+	}
+	return items, nil
+}
+
+// Versions returns the versions of a KV secret
+func (backend *VaultBackend) Versions(ctx context.Context, objectType, name string) ([]ObjectItem, error) {
+	if objectType != VaultTypeSecret {
+		return nil, fmt.Errorf("versions of %s objects are not supported by the vault provider", objectType)
+	}
+	var data struct {
+		Versions map[string]vaultKVMetadata `json:"versions"`
+	}
+	if err := backend.read(ctx, "GET", path.Join(backend.kvPath, "metadata", name), nil, nil, &data); err != nil {
+		return nil, err
+	}
+	var items []ObjectItem
+	for number, metadata := range data.Versions {
+		metadata.Version, _ = strconv.Atoi(number)
+		items = append(items, kvItem(name, metadata))
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, _ := strconv.Atoi(items[i].Version)
+		b, _ := strconv.Atoi(items[j].Version)
+		return a < b
+	})
+	return items, nil
+}
+
+// kvItem describes a version of a KV secret, deleted and destroyed versions are disabled
+func kvItem(name string, metadata vaultKVMetadata) ObjectItem {
+	enabled := metadata.DeletionTime == "" && !metadata.Destroyed
+	item := ObjectItem{Type: VaultTypeSecret, Name: name, Version: strconv.Itoa(metadata.Version), Enabled: &enabled}
+	if created, err := time.Parse(time.RFC3339Nano, metadata.CreatedTime); err == nil {
+		item.Created = &created
+	}
+	return item
+}
+
+// read calls the Vault API and decodes the data of the response into data
+func (backend *VaultBackend) read(ctx context.Context, method, apiPath string, query url.Values, body, data interface{}) error {
+	var resp vaultResponse
+	if err := backend.do(ctx, method, apiPath, query, body, &resp); err != nil {
+		return err
+	}
+	if len(resp.Data) == 0 {
+		return fmt.Errorf("vault returned no data for %s", apiPath)
+	}
+	return json.Unmarshal(resp.Data, data)
+}
+
+// do calls the Vault API at /v1/apiPath with the token of the backend
+func (backend *VaultBackend) do(ctx context.Context, method, apiPath string, query url.Values, body interface{}, resp *vaultResponse) error {
+	endpoint := fmt.Sprintf("%s/v1/%s", backend.address, apiPath)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if backend.token != "" {
+		req.Header.Set("X-Vault-Token", backend.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "vault request %s %s failed", method, apiPath)
+	}
+	defer func() {
+		if err := httpResp.Body.Close(); err != nil {
+			glog.Warning("failed to close vault response body")
+		}
+	}()
+	respBody, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read vault response to %s %s", method, apiPath)
+	}
+	var parseErr error
+	if len(respBody) > 0 {
+		parseErr = json.Unmarshal(respBody, resp)
+	}
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		// the errors of a proxy in front of Vault are not JSON
+		return &BackendError{
+			StatusCode: httpResp.StatusCode,
+			Message:    fmt.Sprintf("vault request %s %s returned status code %d: %s", method, apiPath, httpResp.StatusCode, strings.Join(resp.Errors, "; ")),
+		}
+	}
+	if parseErr != nil {
+		return errors.Wrapf(parseErr, "failed to parse vault response to %s %s", method, apiPath)
+	}
+	return nil
+}
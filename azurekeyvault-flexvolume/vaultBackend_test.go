@@ -0,0 +1,345 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testVaultToken = "s.testtoken"
+
+// testVault is a Vault server answering with handler, recording the requests
+type testVault struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []string
+}
+
+func startTestVault(t *testing.T, handler http.HandlerFunc) *testVault {
+	vault := &testVault{}
+	vault.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vault.mutex.Lock()
+		vault.requests = append(vault.requests, r.Method+" "+r.URL.Path)
+		vault.mutex.Unlock()
+		if !strings.HasSuffix(r.URL.Path, "/login") && r.Header.Get("X-Vault-Token") != testVaultToken {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		handler(w, r)
+	}))
+	return vault
+}
+
+// backend returns a backend of the server, authenticated with testVaultToken
+func (vault *testVault) backend() *VaultBackend {
+	return &VaultBackend{address: vault.URL, token: testVaultToken, kvPath: "secret", pkiPath: "pki", pkiRole: "web-role", issued: map[string]*ObjectBundle{}}
+}
+
+func TestVaultKubernetesLogin(t *testing.T) {
+	var body map[string]string
+	vault := startTestVault(t, func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		if r.Method != "POST" || r.URL.Path != "/v1/auth/k8s/login" || r.Header.Get("X-Vault-Token") != "" {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{"unexpected " + r.Method + " " + r.URL.Path}})
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{err.Error()}})
+			return
+		}
+		switch {
+		case body["role"] == "web" && body["jwt"] == "pod-token":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"auth": map[string]string{"client_token": testVaultToken}})
+		case body["role"] == "noauth":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]string{}})
+		default:
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		}
+	})
+	defer vault.Close()
+
+	tokenFile, err := ioutil.TempFile("", "kv-vault-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	if _, err := tokenFile.WriteString("pod-token\n"); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile.Close()
+
+	tests := []struct {
+		name      string
+		role      string
+		jwt       string
+		tokenFile string
+		// a part of the expected error
+		wantErr string
+	}{
+		{name: "pod token", role: "web", jwt: "pod-token"},
+		{name: "token file", role: "web", tokenFile: tokenFile.Name()},
+		{name: "pod token over the token file", role: "web", jwt: "pod-token", tokenFile: "/missing"},
+		{name: "denied", role: "web", jwt: "other-token", wantErr: "status code 403: permission denied"},
+		{name: "no auth in the response", role: "noauth", jwt: "pod-token", wantErr: "returned no token"},
+		{name: "no token", role: "web", wantErr: "no service account token"},
+		{name: "missing token file", role: "web", tokenFile: "/missing", wantErr: "failed to read the service account token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := Option{vaultAddr: vault.URL + "/", vaultRole: test.role, vaultAuthPath: "/k8s/", vaultServiceAccountToken: test.jwt, vaultServiceAccountTokenFile: test.tokenFile}
+			backend, err := newVaultBackend(context.Background(), options)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token := backend.(*VaultBackend).token; token != testVaultToken {
+				t.Errorf("token = %q, want the client token of the login", token)
+			}
+			if body["role"] != test.role || body["jwt"] != "pod-token" {
+				t.Errorf("login body = %v", body)
+			}
+		})
+	}
+
+	// a Vault token skips the login
+	requests := len(vault.requests)
+	backend, err := newVaultBackend(context.Background(), Option{vaultAddr: vault.URL, vaultToken: "s.other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.(*VaultBackend).token != "s.other" || len(vault.requests) != requests {
+		t.Errorf("logged in with a Vault token")
+	}
+}
+
+func TestVaultGetSecret(t *testing.T) {
+	var versions []string
+	vault := startTestVault(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/v1/secret/data/db" {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		version := r.URL.Query().Get("version")
+		versions = append(versions, version)
+		metadata := map[string]interface{}{"created_time": "2020-01-02T03:04:05.123456Z", "deletion_time": "", "destroyed": false, "version": 3}
+		switch version {
+		case "":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": map[string]interface{}{"value": "s3cret"}, "metadata": metadata}})
+		case "2":
+			metadata["version"] = 2
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": map[string]interface{}{"password": "s3cret", "user": "admin"}, "metadata": metadata}})
+		case "1":
+			// Vault answers 404 with the metadata of a deleted version
+			metadata["version"], metadata["deletion_time"] = 1, "2020-01-03T00:00:00Z"
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"data": map[string]interface{}{"data": nil, "metadata": metadata}})
+		default:
+			metadata["version"], metadata["destroyed"] = 4, true
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": nil, "metadata": metadata}})
+		}
+	})
+	defer vault.Close()
+	backend := vault.backend()
+	ctx := context.Background()
+
+	secret, err := backend.GetSecret(ctx, "db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Value) != "s3cret" || secret.ContentType != "" || secret.Version != "3" || !*secret.Enabled {
+		t.Errorf("secret = %+v %s, want the value field of version 3", secret.ObjectItem, secret.Value)
+	}
+	if secret.Created == nil || !secret.Created.Equal(time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)) {
+		t.Errorf("created = %v", secret.Created)
+	}
+
+	secret, err = backend.GetSecret(ctx, "db", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Value) != `{"password":"s3cret","user":"admin"}` || secret.ContentType != "application/json" || secret.Version != "2" {
+		t.Errorf("secret = %+v %s, want the JSON encoded fields of version 2", secret.ObjectItem, secret.Value)
+	}
+
+	_, err = backend.GetSecret(ctx, "db", "1")
+	if errorStatusCode(err) != http.StatusNotFound {
+		t.Errorf("error = %v, want a 404 for a deleted version", err)
+	}
+	if _, err = backend.GetSecret(ctx, "db", "4"); err == nil || !strings.Contains(err.Error(), "version 4 is deleted") {
+		t.Errorf("error = %v, want the version is deleted", err)
+	}
+	if strings.Join(versions, ",") != ",2,1,4" {
+		t.Errorf("versions requested = %q", versions)
+	}
+}
+
+func TestVaultGetCertificate(t *testing.T) {
+	key, chain := testChain(t, "rsa")
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw}))
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[1].Raw}))
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}))
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	vault := startTestVault(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || r.Method != "POST" || r.URL.Path != "/v1/pki/issue/web-role" || body["common_name"] != "web" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"unexpected request"}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"certificate":   certPEM,
+			"private_key":   keyPEM,
+			"issuing_ca":    caPEM,
+			"serial_number": "1a:2b",
+			"expiration":    expiration.Unix(),
+		}})
+	})
+	defer vault.Close()
+	backend := vault.backend()
+	ctx := context.Background()
+
+	cert, err := backend.GetCertificate(ctx, "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Value, chain[0].Raw) || cert.Version != "1a:2b" || !cert.Expires.Equal(expiration) {
+		t.Errorf("certificate = %+v, want the DER certificate with its serial number as version", cert.ObjectItem)
+	}
+
+	// the secret of the certificate is kept by name and serial number, without a request
+	requests := len(vault.requests)
+	secret, err := backend.GetSecret(ctx, "web", "1a:2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vault.requests) != requests {
+		t.Errorf("the secret of the issued certificate is requested")
+	}
+	if secret.ContentType != pemContentType || string(secret.Value) != strings.Join([]string{keyPEM, certPEM, caPEM}, "\n") {
+		t.Errorf("secret = %s, want the private key, the certificate and the issuing CA", secret.Value)
+	}
+	decodedKey, certs, err := certificateKeyPair(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedKey == nil || len(certs) != 2 || !certs[1].Equal(chain[1]) {
+		t.Errorf("the secret is not a key pair with its chain")
+	}
+	if _, err := backend.GetSecret(ctx, "web", "other"); err == nil || vault.requests[len(vault.requests)-1] != "GET /v1/secret/data/web" {
+		t.Errorf("requests = %v, want the KV secret to be read for another version", vault.requests)
+	}
+
+	if _, err := backend.GetCertificate(ctx, "web", "1a:2b"); err == nil {
+		t.Errorf("a version of a certificate is accepted")
+	}
+	requests = len(vault.requests)
+	readOnly := vault.backend()
+	readOnly.readOnly = true
+	if _, err := readOnly.GetCertificate(ctx, "web", ""); err != errVaultCertificateNotIssued {
+		t.Errorf("error = %v, want %v", err, errVaultCertificateNotIssued)
+	}
+	if len(vault.requests) != requests {
+		t.Errorf("a read only backend issued a certificate")
+	}
+}
+
+func TestVaultVersions(t *testing.T) {
+	vault := startTestVault(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/v1/secret/metadata/db" {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"versions": map[string]interface{}{
+			"10": map[string]interface{}{"created_time": "2020-01-10T00:00:00Z"},
+			"2":  map[string]interface{}{"created_time": "2020-01-02T00:00:00Z"},
+			"1":  map[string]interface{}{"created_time": "2020-01-01T00:00:00Z", "deletion_time": "2020-01-05T00:00:00Z"},
+			"3":  map[string]interface{}{"created_time": "2020-01-03T00:00:00Z", "destroyed": true},
+		}}})
+	})
+	defer vault.Close()
+
+	items, err := vault.backend().Versions(context.Background(), VaultTypeSecret, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range items {
+		state := "enabled"
+		if !*item.Enabled {
+			state = "disabled"
+		}
+		got = append(got, item.Version+" "+state)
+	}
+	if want := "1 disabled, 2 enabled, 3 disabled, 10 enabled"; strings.Join(got, ", ") != want {
+		t.Errorf("versions = %s, want %s", strings.Join(got, ", "), want)
+	}
+	if _, err := vault.backend().Versions(context.Background(), VaultTypeCertificate, "web"); err == nil {
+		t.Errorf("versions of certificates are listed")
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		// a part of the expected message
+		want string
+	}{
+		{name: "vault errors", status: http.StatusForbidden, body: `{"errors": ["permission denied", "1 error occurred"]}`, want: "returned status code 403: permission denied; 1 error occurred"},
+		{name: "empty body", status: http.StatusNotFound, want: "returned status code 404"},
+		{name: "proxy error", status: http.StatusBadGateway, body: "<html>bad gateway</html>", want: "returned status code 502"},
+		{name: "sealed", status: http.StatusServiceUnavailable, body: `{"errors": ["Vault is sealed"]}`, want: "Vault is sealed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vault := startTestVault(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.body))
+			})
+			defer vault.Close()
+
+			_, err := vault.backend().GetSecret(context.Background(), "db", "")
+			backendErr, ok := err.(*BackendError)
+			if !ok {
+				t.Fatalf("error = %#v, want a BackendError", err)
+			}
+			if backendErr.StatusCode != test.status || !strings.Contains(backendErr.Message, test.want) {
+				t.Errorf("error = %d %q, want %d %q", backendErr.StatusCode, backendErr.Message, test.status, test.want)
+			}
+		})
+	}
+
+	// a successful response that cannot be parsed is not a BackendError
+	vault := startTestVault(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not json"))
+	})
+	defer vault.Close()
+	_, err := vault.backend().GetSecret(context.Background(), "db", "")
+	if err == nil || errorStatusCode(err) != 0 || !strings.Contains(err.Error(), "failed to parse vault response") {
+		t.Errorf("error = %v, want a parse error", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// Suffixes of the default detached signature of an object: a secret for the vault objects,
+// Key Vault names cannot contain dots, and a file next to the encrypted files
+const (
+	signatureSecretSuffix = "-sig"
+	signatureFileSuffix   = ".sig"
+)
+
+// verifyObject checks the detached signature of the content written for an object with the public
+// part of a key. verifyWith is the key name, optionally followed by a colon and the name of the
+// signature object. Any failure to get the signature or the key is an error, the check fails closed.
+func verifyObject(ctx context.Context, backend Backend, objectType, objectName, verifyWith string, content []byte) error {
+	keyName, signatureName := verifyWith, ""
+	if i := strings.Index(verifyWith, ":"); i >= 0 {
+		keyName, signatureName = verifyWith[:i], verifyWith[i+1:]
+	}
+	signature, alg, err := getSignature(ctx, backend, objectType, objectName, signatureName)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := backend.GetKey(ctx, keyName, "")
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the verification key %s", keyName)
+	}
+	publicKey, err := jsonWebKeyPublicKey(bundle.Key)
+	if err != nil {
+		return fmt.Errorf("invalid verification key %s: %s", keyName, err)
+	}
+	if alg == "" {
+		alg = defaultSignatureAlgorithm(publicKey)
+	}
+	hash, err := signatureHash(alg)
+	if err != nil {
+		return err
+	}
+	digest := hash.New()
+	digest.Write(content)
+	if err := verifyDigest(publicKey, alg, digest.Sum(nil), signature); err != nil {
+		return fmt.Errorf("the signature of %s %s does not match key %s (version: %s): %s", objectType, objectName, keyName, bundle.Version, err)
+	}
+	glog.V(0).Infof("verified the signature of %s %s with key %s (version: %s) and algorithm %s", objectType, objectName, keyName, bundle.Version, alg)
+	return nil
+}
+
+// getSignature returns the decoded detached signature of an object and its algorithm, empty when
+// it is not set. The signature of an encrypted file is a file, its default name is the path of the
+// file with the .sig suffix. The signature of the other objects is a secret, its default name is
+// the name of the object with the -sig suffix and its content type can set the algorithm.
+func getSignature(ctx context.Context, backend Backend, objectType, objectName, signatureName string) ([]byte, string, error) {
+	var encoded, alg string
+	if objectType == VaultTypeEncryptedFile {
+		if signatureName == "" {
+			signatureName = objectName + signatureFileSuffix
+		}
+		if !filepath.IsAbs(signatureName) {
+			return nil, "", fmt.Errorf("the path of the signature of %s must be absolute, got %s", objectName, signatureName)
+		}
+		content, err := ioutil.ReadFile(signatureName)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to read the signature of %s", objectName)
+		}
+		encoded = string(content)
+	} else {
+		if signatureName == "" {
+			signatureName = objectName + signatureSecretSuffix
+		}
+		bundle, err := backend.GetSecret(ctx, signatureName, "")
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to get the signature %s of %s %s", signatureName, objectType, objectName)
+		}
+		encoded = string(bundle.Value)
+		if _, err := signatureHash(bundle.ContentType); err == nil {
+			alg = bundle.ContentType
+		}
+	}
+
+	// standard or base64url encoded, with or without padding
+	encoded = strings.TrimRight(strings.TrimSpace(encoded), "=")
+	signature, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		signature, err = base64.RawURLEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("the signature %s of %s is not base64 encoded", signatureName, objectName)
+	}
+	return signature, alg, nil
+}
+
+// defaultSignatureAlgorithm returns the algorithm of a signature without algorithm: RS256 for RSA
+// keys, ES256, ES384 or ES512 for EC keys depending on their curve
+func defaultSignatureAlgorithm(publicKey crypto.PublicKey) string {
+	if key, ok := publicKey.(*ecdsa.PublicKey); ok {
+		switch key.Curve {
+		case elliptic.P384():
+			return "ES384"
+		case elliptic.P521():
+			return "ES512"
+		default:
+			return "ES256"
+		}
+	}
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		return "RS256"
+	}
+	return ""
+}
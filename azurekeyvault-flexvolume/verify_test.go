@@ -0,0 +1,117 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSignature returns the signature of content with key and alg, as Key Vault signs its digest
+func testSignature(t *testing.T, key crypto.Signer, alg string, content []byte) []byte {
+	hash, err := signatureHash(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := hash.New()
+	digest.Write(content)
+	signature, err := signDigest(key, alg, digest.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestVerifyObject(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("listen 443 ssl;\n")
+	encode := base64.StdEncoding.EncodeToString
+
+	backend := &FileBackend{objects: map[string]map[string][]FileObject{}}
+	backend.add(VaultTypeKey, FileObject{Name: "signer", Version: "1", PEM: testKeyPEM(t, rsaKey)})
+	backend.add(VaultTypeKey, FileObject{Name: "ecsigner", Version: "1", PEM: testKeyPEM(t, ecKey)})
+	for _, secret := range []FileObject{
+		{Name: "config-sig", Value: encode(testSignature(t, rsaKey, "RS256", content))},
+		{Name: "config-pss", Value: encode(testSignature(t, rsaKey, "PS512", content)), ContentType: "PS512"},
+		{Name: "config-url", Value: base64.RawURLEncoding.EncodeToString(testSignature(t, rsaKey, "RS256", content)) + "\n"},
+		{Name: "config-ec", Value: encode(testSignature(t, ecKey, "ES384", content))},
+		{Name: "other-sig", Value: encode(testSignature(t, rsaKey, "RS256", []byte("other content")))},
+		{Name: "config-wrongalg", Value: encode(testSignature(t, rsaKey, "RS256", content)), ContentType: "PS256"},
+		{Name: "config-invalid", Value: "not a signature!"},
+	} {
+		secret.Version = "1"
+		backend.add(VaultTypeSecret, secret)
+	}
+
+	dir, err := ioutil.TempDir("", "kv-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	encryptedFile := filepath.Join(dir, "config.enc")
+	if err := ioutil.WriteFile(encryptedFile+signatureFileSuffix, []byte(encode(testSignature(t, rsaKey, "RS256", content))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		objectType string
+		objectName string
+		verifyWith string
+		// a part of the expected error, empty when the signature is good
+		wantErr string
+	}{
+		{name: "default signature", objectType: VaultTypeSecret, objectName: "config", verifyWith: "signer"},
+		{name: "named signature with its algorithm", objectType: VaultTypeSecret, objectName: "config", verifyWith: "signer:config-pss"},
+		{name: "base64url signature", objectType: VaultTypeSecret, objectName: "config", verifyWith: "signer:config-url"},
+		{name: "EC key", objectType: VaultTypeSecret, objectName: "config", verifyWith: "ecsigner:config-ec"},
+		{name: "signature file of an encrypted file", objectType: VaultTypeEncryptedFile, objectName: encryptedFile, verifyWith: "signer"},
+		{name: "signature of other content", objectType: VaultTypeSecret, objectName: "other", verifyWith: "signer", wantErr: "does not match key signer"},
+		{name: "another key", objectType: VaultTypeSecret, objectName: "config", verifyWith: "ecsigner", wantErr: "does not match key ecsigner"},
+		{name: "another algorithm", objectType: VaultTypeSecret, objectName: "config", verifyWith: "signer:config-wrongalg", wantErr: "does not match"},
+		{name: "missing signature", objectType: VaultTypeSecret, objectName: "missing", verifyWith: "signer", wantErr: "failed to get the signature missing-sig"},
+		{name: "missing key", objectType: VaultTypeSecret, objectName: "config", verifyWith: "missing", wantErr: "failed to get the verification key missing"},
+		{name: "invalid signature", objectType: VaultTypeSecret, objectName: "config", verifyWith: "signer:config-invalid", wantErr: "not base64 encoded"},
+		{name: "missing signature file", objectType: VaultTypeEncryptedFile, objectName: filepath.Join(dir, "other.enc"), verifyWith: "signer", wantErr: "failed to read the signature"},
+		{name: "relative signature file", objectType: VaultTypeEncryptedFile, objectName: encryptedFile, verifyWith: "signer:config.sig", wantErr: "must be absolute"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyObject(context.Background(), backend, test.objectType, test.objectName, test.verifyWith, content)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyObject: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+
+	// a modified content never matches its signature
+	if err := verifyObject(context.Background(), backend, VaultTypeSecret, "config", "signer", append(content, ' ')); err == nil {
+		t.Errorf("the signature matches a modified content")
+	}
+}
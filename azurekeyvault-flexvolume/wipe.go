@@ -0,0 +1,225 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// volumeManifestsDir is the directory of the state dir holding the manifests of the volumes
+const volumeManifestsDir = "manifests"
+
+// errOutsideVolume is the cause of the errors of the files of a manifest that are not wiped,
+// because they are or resolve outside of the volume
+var errOutsideVolume = fmt.Errorf("not wiped")
+
+// volumeManifest is the content of the manifest of a volume
+type volumeManifest struct {
+	// paths of the files relative to the volume
+	Files []string `json:"files"`
+}
+
+// volumeManifestPath returns the path of the manifest of dir in stateDir. The manifests are kept
+// out of the volumes, the pods must not choose the files wiped by the driver.
+func volumeManifestPath(stateDir, dir string) string {
+	return filepath.Join(stateDir, volumeManifestsDir, fmt.Sprintf("%x", sha256.Sum256([]byte(filepath.Clean(dir)))))
+}
+
+// writeVolumeManifest lists the files in the manifest of dir. It is written before the
+// files, so the files of a partially written volume are wiped too.
+func writeVolumeManifest(stateDir, dir string, files []string) error {
+	content, err := json.Marshal(volumeManifest{Files: files})
+	if err != nil {
+		return err
+	}
+	manifestPath := volumeManifestPath(stateDir, dir)
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create the directory of the volume manifest %s", manifestPath)
+	}
+	if err := ioutil.WriteFile(manifestPath, content, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write the volume manifest %s", manifestPath)
+	}
+	return nil
+}
+
+// wipeBeforeUnmount wipes the volume at dir before it is unmounted. The wipe is best effort and
+// never prevents the unmount, it returns a report of the files left in dir, empty when there are none.
+func wipeBeforeUnmount(stateDir, dir string) string {
+	leftovers, err := wipeVolume(stateDir, dir)
+	if err != nil {
+		glog.Errorf("failed to wipe %s: %s", dir, err)
+		return fmt.Sprintf("failed to wipe %s: %s", dir, err)
+	}
+	if len(leftovers) == 0 {
+		return ""
+	}
+	report := fmt.Sprintf("files left in %s after the wipe: %s", dir, strings.Join(leftovers, ", "))
+	glog.Warning(report)
+	return report
+}
+
+// wipeVolume overwrites and removes the files of the manifest of dir, then the manifest.
+// It returns the files that are left in dir: the ones that could not be wiped, which stay in
+// the manifest for the next call while dir exists, and the ones that were not written by the driver.
+// The files resolving outside of dir are never wiped, they are logged and dropped from the manifest.
+// Overwriting is best effort, the filesystem or the swap may still hold copies of the content.
+func wipeVolume(stateDir, dir string) ([]string, error) {
+	manifestPath := volumeManifestPath(stateDir, dir)
+	content, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		// never written or already wiped by a previous call
+		return listVolume(dir)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the volume manifest %s", manifestPath)
+	}
+	var manifest volumeManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the volume manifest %s", manifestPath)
+	}
+
+	var remaining []string
+	for _, file := range manifest.Files {
+		err := wipeFile(dir, file)
+		if errors.Cause(err) == errOutsideVolume {
+			glog.Warningf("skipped %s: %s", file, err)
+			continue
+		}
+		if err != nil {
+			glog.Errorf("failed to wipe %s: %s", file, err)
+			remaining = append(remaining, file)
+			continue
+		}
+		glog.V(2).Infof("wiped %s", file)
+	}
+	if _, err := os.Lstat(dir); os.IsNotExist(err) && len(remaining) > 0 {
+		glog.Warningf("%s is gone, dropping the files left in its manifest: %s", dir, strings.Join(remaining, ", "))
+		remaining = nil
+	}
+	if len(remaining) > 0 {
+		if err := writeVolumeManifest(stateDir, dir, remaining); err != nil {
+			return nil, err
+		}
+	} else if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to remove the volume manifest %s", manifestPath)
+	}
+	return listVolume(dir)
+}
+
+// wipeFile overwrites a regular file of dir with zeros and removes it, a missing file is already wiped.
+// The pods can replace the files and directories of the volume with symlinks, so the directory of the
+// file is resolved and must stay inside dir, and the file itself is never followed.
+func wipeFile(dir, file string) error {
+	filePath := filepath.Join(dir, file)
+	if !strings.HasPrefix(filePath, filepath.Clean(dir)+string(filepath.Separator)) {
+		return errors.Wrapf(errOutsideVolume, "%s is outside of %s", file, dir)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(filePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.Wrapf(errOutsideVolume, "%s resolves outside of %s", file, dir)
+	}
+	filePath = filepath.Join(parent, filepath.Base(filePath))
+
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		if err := overwriteFile(filePath, info); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// overwriteFile writes zeros over the content of the file of info and flushes them. The file is
+// not overwritten when it was replaced since info, e.g. by a symlink.
+func overwriteFile(filePath string, info os.FileInfo) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	opened, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if !os.SameFile(info, opened) {
+		file.Close()
+		return fmt.Errorf("%s was replaced while it was wiped", filePath)
+	}
+	size := info.Size()
+	zeros := make([]byte, 32*1024)
+	for written := int64(0); written < size; {
+		n := int64(len(zeros))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := file.Write(zeros[:n]); err != nil {
+			file.Close()
+			return err
+		}
+		written += n
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// listVolume returns the paths of the files left in dir, relative to dir
+func listVolume(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, relPath)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
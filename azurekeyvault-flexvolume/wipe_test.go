@@ -0,0 +1,133 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWipeVolume(t *testing.T) {
+	base, err := ioutil.TempDir("", "kv-wipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	stateDir := filepath.Join(base, "state")
+	dir := filepath.Join(base, "volume")
+	outside := filepath.Join(base, "host")
+	for _, d := range []string{filepath.Join(dir, "tls"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hostFile := filepath.Join(outside, "shadow")
+	if err := ioutil.WriteFile(hostFile, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"secret", "tls/tls.key", "link", "linkdir/shadow"}
+	if err := writeVolumeManifest(stateDir, dir, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(volumeManifestPath(stateDir, dir)); err != nil {
+		t.Fatalf("the manifest is not in the state dir: %s", err)
+	}
+	for _, file := range []string{"secret", "tls/tls.key"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("value"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the pod replaces files of the volume with symlinks to files of the host
+	if err := os.Symlink(hostFile, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+
+	leftovers, err := wipeVolume(stateDir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"linkdir"}; !reflect.DeepEqual(leftovers, want) {
+		t.Errorf("leftovers = %v, want %v", leftovers, want)
+	}
+	content, err := ioutil.ReadFile(hostFile)
+	if err != nil || string(content) != "host" {
+		t.Errorf("the host file was wiped through a symlink: %q, %v", content, err)
+	}
+
+	// the file that resolves outside of the volume is dropped from the manifest
+	if _, err := os.Stat(volumeManifestPath(stateDir, dir)); !os.IsNotExist(err) {
+		t.Errorf("the manifest is kept for a file outside of the volume: %v", err)
+	}
+	if _, err := os.Stat(hostFile); err != nil {
+		t.Errorf("the host file was removed: %s", err)
+	}
+}
+
+func TestWipeVolumeRemaining(t *testing.T) {
+	base, err := ioutil.TempDir("", "kv-wipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	stateDir := filepath.Join(base, "state")
+	dir := filepath.Join(base, "volume")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the pod replaces a directory of the volume with a file, its files cannot be wiped
+	if err := ioutil.WriteFile(filepath.Join(dir, "tls"), []byte("value"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeVolumeManifest(stateDir, dir, []string{"secret", "tls/tls.key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	leftovers, err := wipeVolume(stateDir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tls"}; !reflect.DeepEqual(leftovers, want) {
+		t.Errorf("leftovers = %v, want %v", leftovers, want)
+	}
+	content, err := ioutil.ReadFile(volumeManifestPath(stateDir, dir))
+	if err != nil {
+		t.Fatalf("the manifest of the file that failed is removed: %s", err)
+	}
+	if string(content) != `{"files":["tls/tls.key"]}` {
+		t.Errorf("manifest = %s, want the file that failed", content)
+	}
+
+	// once the volume is gone, the manifest is removed
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	leftovers, err = wipeVolume(stateDir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("leftovers = %v in a removed volume", leftovers)
+	}
+	if _, err := os.Stat(volumeManifestPath(stateDir, dir)); !os.IsNotExist(err) {
+		t.Errorf("the manifest of a removed volume is kept: %v", err)
+	}
+}
+
+func TestVolumeManifestPath(t *testing.T) {
+	if volumeManifestPath("/var/lib/kv-driver", "/mnt/a/") != volumeManifestPath("/var/lib/kv-driver", "/mnt/a") {
+		t.Errorf("the manifest path depends on the trailing separator")
+	}
+	if volumeManifestPath("/var/lib/kv-driver", "/mnt/a") == volumeManifestPath("/var/lib/kv-driver", "/mnt/b") {
+		t.Errorf("two volumes share a manifest")
+	}
+}
@@ -12,9 +12,15 @@ fi
 kv_vol_dir="${target_dir}/azure~kv"
 mkdir -p ${kv_vol_dir}
 
-#copy
-cp /bin/kv ${kv_vol_dir}/kv
-cp /bin/azurekeyvault-flexvolume ${kv_vol_dir}/azurekeyvault-flexvolume #script
+#copy, the driver binary implements the flexvolume calls itself
+#write to a temporary file first so the kubelet never executes a partial copy
+cp /bin/azurekeyvault-flexvolume ${kv_vol_dir}/.kv
+mv -f ${kv_vol_dir}/.kv ${kv_vol_dir}/kv
+rm -f ${kv_vol_dir}/azurekeyvault-flexvolume
+
+#the settings of the node are flags of the driver, the volumes cannot set them
+echo "${KV_DRIVER_FLAGS}" > ${kv_vol_dir}/.kv.conf
+mv -f ${kv_vol_dir}/.kv.conf ${kv_vol_dir}/kv.conf
 
 
 #https://github.com/kubernetes/kubernetes/issues/17182